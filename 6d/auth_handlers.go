@@ -2,7 +2,6 @@ package main
 
 import (
 	"crypto/rand"
-	"log"
 	"math/big"
 	"time"
 
@@ -11,6 +10,35 @@ import (
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
+const (
+	// phoneCodeTTL is how long a login code can be used after it was sent
+	phoneCodeTTL = 5 * time.Minute
+	// maxPhoneCodeAttempts is how many wrong codes a hash survives
+	maxPhoneCodeAttempts = 5
+	// resendCodeInterval is how long auth.resendCode waits after a delivery
+	resendCodeInterval = 60 * time.Second
+)
+
+// nextCodeType returns how a code delivered as codeType (an auth.SentCodeType
+// predicate) is resent: app codes go out once more by SMS, after that there
+// is nothing left. Returns "" if the code can't be resent.
+func nextCodeType(codeType string) string {
+	if codeType == "auth_sentCodeTypeApp" {
+		return "auth_sentCodeTypeSms"
+	}
+	return ""
+}
+
+// resendFloodWait returns how many seconds, rounded up, a code sent at sentAt
+// has to wait before it can be resent, or 0 if it can be resent now.
+func resendFloodWait(sentAt, now time.Time) int32 {
+	wait := sentAt.Add(resendCodeInterval).Sub(now)
+	if wait <= 0 {
+		return 0
+	}
+	return int32((wait + time.Second - 1) / time.Second)
+}
+
 // HandleAuthSendCode handles TL_auth_sendCode requests
 func (cp *ConnProp) HandleAuthSendCode(obj *mtproto.TLAuthSendCode, msgId, salt, sessionId int64) {
 	phoneNumber := obj.GetPhoneNumber()
@@ -19,61 +47,180 @@ func (cp *ConnProp) HandleAuthSendCode(obj *mtproto.TLAuthSendCode, msgId, salt,
 	// Check if this auth key already has a user
 	if cp.userID != 0 {
 		logf(1, "[Conn %d] Auth key already has user %d, ignoring sendCode\n", cp.connID, cp.userID)
+		cp.sendRpcError(mtproto.ErrInputRequestInvalid, msgId, salt, sessionId)
 		return
 	}
 
 	// Generate phone code hash
 	phoneCodeHash := crypto.GenerateStringNonce(16)
 
-	// Generate a random 5-digit code
-	code := generateVerificationCode(5)
+	// Test numbers have a fixed code, everyone else gets a random one
+	code, testPhone := testPhoneCodes[phoneNumber]
+	if !testPhone {
+		code = generateVerificationCode(verificationCodeLength)
+	}
 
-	// Save to database with auth_key_id
+	// Save before delivering, so the user never gets a code the server
+	// doesn't know. Test numbers count as sent by SMS.
+	codeType := sentCodeTypeSms(len(code))
 	phoneCodeDoc := &PhoneCodeDoc{
 		PhoneNumber:   phoneNumber,
 		PhoneCodeHash: phoneCodeHash,
 		AuthKeyID:     cp.authKey.AuthKeyId(),
 		Code:          code,
-		ExpiresAt:     time.Now().Add(5 * time.Minute),
+		CodeType:      codeType.PredicateName,
+		SentAt:        time.Now(),
+		ExpiresAt:     time.Now().Add(phoneCodeTTL),
 		Verified:      false,
 	}
 
 	if err := SavePhoneCode(phoneCodeDoc); err != nil {
 		logf(1, "[Conn %d] Failed to save phone code: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
 		return
 	}
 
-	// In production, send SMS here
-	log.Printf("[Conn %d] Verification code for %s: %s (hash: %s)", cp.connID, phoneNumber, code, phoneCodeHash)
+	if testPhone {
+		logf(1, "[Conn %d] Test phone %s, fixed code (hash: %s)\n", cp.connID, phoneNumber, phoneCodeHash)
+	} else {
+		var err error
+		if codeType, err = deliverCode(codeSenders, phoneNumber, code); err != nil {
+			logf(1, "[Conn %d] Failed to deliver code: %v\n", cp.connID, err)
+			if err := DeletePhoneCode(phoneCodeHash); err != nil {
+				logf(1, "[Conn %d] Failed to delete phone code: %v\n", cp.connID, err)
+			}
+			cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+			return
+		}
+		logf(1, "[Conn %d] Code for %s sent as %s (hash: %s)\n", cp.connID, phoneNumber, codeType.PredicateName, phoneCodeHash)
+		if codeType.PredicateName != phoneCodeDoc.CodeType {
+			if err := UpdatePhoneCodeDelivery(phoneCodeHash, codeType.PredicateName); err != nil {
+				logf(1, "[Conn %d] Failed to update phone code: %v\n", cp.connID, err)
+			}
+		}
+	}
+
+	cp.sendSentCode(phoneCodeHash, codeType, msgId, salt, sessionId)
+}
 
-	// Send response
+// sendSentCode answers with an auth.sentCode for phoneCodeHash, offering a
+// resend by SMS if nextCodeType allows one.
+func (cp *ConnProp) sendSentCode(phoneCodeHash string, codeType *mtproto.Auth_SentCodeType, msgId, salt, sessionId int64) {
 	result := &mtproto.TLAuthSentCode{
 		Data2: &mtproto.Auth_SentCode{
 			PredicateName: "auth_sentCode",
 			Constructor:   1577067778,
-			Type: &mtproto.Auth_SentCodeType{
-				PredicateName:      "auth_sentCodeTypeSms",
-				Constructor:        -1073693790,
-				Length:             5,
-				Nonce:              nil,
-				PlayIntegrityNonce: nil,
-			},
+			Type:          codeType,
 			PhoneCodeHash: phoneCodeHash,
-			NextType: &mtproto.Auth_CodeType{
-				PredicateName: "auth_codeTypeSms",
-				Constructor:   1923290508,
-			},
-			Timeout: &wrapperspb.Int32Value{Value: 60},
 		},
 	}
+	if nextCodeType(codeType.PredicateName) == "auth_sentCodeTypeSms" {
+		result.Data2.NextType = &mtproto.Auth_CodeType{
+			PredicateName: "auth_codeTypeSms",
+			Constructor:   1923290508,
+		}
+		result.Data2.Timeout = &wrapperspb.Int32Value{Value: int32(resendCodeInterval / time.Second)}
+	}
 
 	buf := mtproto.NewEncodeBuf(512)
 	buf.Int(-212046591)
-	buf.Long(msgId)     
-	result.Encode(buf, 158)
+	buf.Long(msgId)
+	result.Encode(buf, cp.encodeLayer())
 	cp.send(buf.GetBuf(), salt, sessionId)
 }
 
+// findPendingPhoneCode loads the code behind phoneCodeHash for
+// auth.resendCode and auth.cancelCode. It sends the RPC error and returns nil
+// if the hash can't be used by this auth key for phoneNumber.
+func (cp *ConnProp) findPendingPhoneCode(phoneNumber, phoneCodeHash string, msgId, salt, sessionId int64) *PhoneCodeDoc {
+	if phoneCodeHash == "" {
+		cp.sendRpcError(mtproto.ErrPhoneCodeHashEmpty, msgId, salt, sessionId)
+		return nil
+	}
+	phoneCodeDoc, err := FindPhoneCode(phoneCodeHash)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to find phone code: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return nil
+	}
+	if phoneCodeDoc == nil || phoneCodeDoc.AuthKeyID != cp.authKey.AuthKeyId() ||
+		phoneCodeDoc.Verified || time.Now().After(phoneCodeDoc.ExpiresAt) ||
+		phoneCodeDoc.Attempts >= maxPhoneCodeAttempts {
+		cp.sendRpcError(mtproto.ErrPhoneCodeExpired, msgId, salt, sessionId)
+		return nil
+	}
+	if phoneCodeDoc.PhoneNumber != phoneNumber {
+		cp.sendRpcError(mtproto.ErrPhoneNumberInvalid, msgId, salt, sessionId)
+		return nil
+	}
+	return phoneCodeDoc
+}
+
+// HandleAuthResendCode handles TL_auth_resendCode requests
+func (cp *ConnProp) HandleAuthResendCode(obj *mtproto.TLAuthResendCode, msgId, salt, sessionId int64) {
+	phoneNumber := obj.GetPhoneNumber()
+	phoneCodeHash := obj.GetPhoneCodeHash()
+	logf(1, "[Conn %d] auth.resendCode for phone: %s\n", cp.connID, phoneNumber)
+
+	phoneCodeDoc := cp.findPendingPhoneCode(phoneNumber, phoneCodeHash, msgId, salt, sessionId)
+	if phoneCodeDoc == nil {
+		return
+	}
+
+	next := nextCodeType(phoneCodeDoc.CodeType)
+	if next == "" {
+		cp.sendRpcError(mtproto.ErrSendCodeUnavailable, msgId, salt, sessionId)
+		return
+	}
+	if wait := resendFloodWait(phoneCodeDoc.SentAt, time.Now()); wait > 0 {
+		cp.sendRpcError(mtproto.NewErrFloodWaitX(wait), msgId, salt, sessionId)
+		return
+	}
+
+	// Claim the resend first so concurrent requests send one SMS at most
+	claimed, err := ClaimPhoneCodeResend(phoneCodeHash, phoneCodeDoc.CodeType, next, time.Now().Add(-resendCodeInterval))
+	if err != nil {
+		logf(1, "[Conn %d] Failed to update phone code: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	if !claimed {
+		cp.sendRpcError(mtproto.NewErrFloodWaitX(int32(resendCodeInterval/time.Second)), msgId, salt, sessionId)
+		return
+	}
+
+	// The same code goes out again by SMS; its expiry stays as it was
+	codeType, err := deliverCode([]CodeSender{smsCodeSender}, phoneNumber, phoneCodeDoc.Code)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to resend code: %v\n", cp.connID, err)
+		if err := UpdatePhoneCodeDelivery(phoneCodeHash, phoneCodeDoc.CodeType); err != nil {
+			logf(1, "[Conn %d] Failed to update phone code: %v\n", cp.connID, err)
+		}
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	logf(1, "[Conn %d] Code for %s resent as %s (was %s)\n", cp.connID, phoneNumber, codeType.PredicateName, phoneCodeDoc.CodeType)
+
+	cp.sendSentCode(phoneCodeHash, codeType, msgId, salt, sessionId)
+}
+
+// HandleAuthCancelCode handles TL_auth_cancelCode requests
+func (cp *ConnProp) HandleAuthCancelCode(obj *mtproto.TLAuthCancelCode, msgId, salt, sessionId int64) {
+	phoneNumber := obj.GetPhoneNumber()
+	phoneCodeHash := obj.GetPhoneCodeHash()
+	logf(1, "[Conn %d] auth.cancelCode for phone: %s\n", cp.connID, phoneNumber)
+
+	if cp.findPendingPhoneCode(phoneNumber, phoneCodeHash, msgId, salt, sessionId) == nil {
+		return
+	}
+	if err := DeletePhoneCode(phoneCodeHash); err != nil {
+		logf(1, "[Conn %d] Failed to cancel phone code: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	cp.encodeAndSend(mtproto.MakeTLBoolTrue(nil), msgId, salt, sessionId, 64)
+}
+
 // HandleAuthSignIn handles TL_auth_signIn requests
 func (cp *ConnProp) HandleAuthSignIn(obj *mtproto.TLAuthSignIn, msgId, salt, sessionId int64) {
 	phoneNumber := obj.GetPhoneNumber()
@@ -85,33 +232,82 @@ func (cp *ConnProp) HandleAuthSignIn(obj *mtproto.TLAuthSignIn, msgId, salt, ses
 	if cp.userID != 0 {
 		logf(1, "[Conn %d] Already authenticated as user %d\n", cp.connID, cp.userID)
 		// User already logged in, just return their info
-		user, _ := FindUserByID(cp.userID)
-		if user != nil {
-			cp.createSessionForUser(user, msgId, salt, sessionId)
+		user, err := FindUserByID(cp.userID)
+		if err != nil || user == nil {
+			logf(1, "[Conn %d] Failed to load user %d: %v\n", cp.connID, cp.userID, err)
+			cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+			return
 		}
+		cp.createSessionForUser(user, msgId, salt, sessionId)
 		return
 	}
 
 	// Verify phone code
+	if phoneCodeHash == "" {
+		cp.sendRpcError(mtproto.ErrPhoneCodeHashEmpty, msgId, salt, sessionId)
+		return
+	}
 	phoneCodeDoc, err := FindPhoneCode(phoneCodeHash)
-	if err != nil || phoneCodeDoc == nil {
+	if err != nil {
+		logf(1, "[Conn %d] Failed to find phone code: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	if phoneCodeDoc == nil {
+		// Unknown hashes are treated like codes that already expired and got purged
 		logf(1, "[Conn %d] Invalid phone code hash\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneCodeExpired, msgId, salt, sessionId)
 		return
 	}
 
 	// Verify this phone code belongs to this auth key
 	if phoneCodeDoc.AuthKeyID != cp.authKey.AuthKeyId() {
 		logf(1, "[Conn %d] Phone code auth key mismatch\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneCodeExpired, msgId, salt, sessionId)
 		return
 	}
 
 	if phoneCodeDoc.PhoneNumber != phoneNumber {
 		logf(1, "[Conn %d] Phone number mismatch\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneNumberInvalid, msgId, salt, sessionId)
 		return
 	}
 
 	if time.Now().After(phoneCodeDoc.ExpiresAt) {
 		logf(1, "[Conn %d] Phone code expired\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneCodeExpired, msgId, salt, sessionId)
+		return
+	}
+
+	if phoneCodeDoc.Attempts >= maxPhoneCodeAttempts {
+		logf(1, "[Conn %d] Phone code used up\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneCodeExpired, msgId, salt, sessionId)
+		return
+	}
+
+	phoneCode := obj.GetPhoneCode_FLAGSTRING().GetValue()
+	if phoneCode == "" {
+		phoneCode = obj.GetPhoneCode_STRING()
+	}
+	if phoneCode == "" {
+		cp.sendRpcError(mtproto.ErrPhoneCodeEmpty, msgId, salt, sessionId)
+		return
+	}
+	if phoneCode != phoneCodeDoc.Code {
+		attempts, err := RecordPhoneCodeAttempt(phoneCodeHash)
+		if err != nil {
+			logf(1, "[Conn %d] Failed to record phone code attempt: %v\n", cp.connID, err)
+		}
+		logf(1, "[Conn %d] Wrong phone code (%d/%d)\n", cp.connID, attempts, maxPhoneCodeAttempts)
+		if attempts >= maxPhoneCodeAttempts {
+			// Out of attempts: the hash is gone and a new code is needed
+			if err := DeletePhoneCode(phoneCodeHash); err != nil {
+				logf(1, "[Conn %d] Failed to delete phone code: %v\n", cp.connID, err)
+			}
+			cp.sendRpcError(mtproto.ErrPhoneCodeExpired, msgId, salt, sessionId)
+			return
+		}
+		cp.sendRpcError(mtproto.ErrPhoneCodeInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -122,6 +318,7 @@ func (cp *ConnProp) HandleAuthSignIn(obj *mtproto.TLAuthSignIn, msgId, salt, ses
 	user, err := FindUserByPhone(phoneNumber)
 	if err != nil {
 		logf(1, "[Conn %d] Database error: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
 		return
 	}
 
@@ -139,11 +336,22 @@ func (cp *ConnProp) HandleAuthSignIn(obj *mtproto.TLAuthSignIn, msgId, salt, ses
 		buf := mtproto.NewEncodeBuf(512)
 		buf.Int(-212046591) // rpc_result constructor
 		buf.Long(msgId)     // original request msg_id
-		result.Encode(buf, 158)
+		result.Encode(buf, cp.encodeLayer())
 		cp.send(buf.GetBuf(), salt, sessionId)
 		return
 	}
 
+	// Accounts with a cloud password need auth.checkPassword first
+	if user.Password != nil {
+		passwordLogins.Store(cp.userAuthKeyID(), &passwordLogin{
+			userID:    user.ID,
+			expiresAt: time.Now().Add(passwordLoginTTL),
+		})
+		logf(1, "[Conn %d] User %d has a password, sending SESSION_PASSWORD_NEEDED\n", cp.connID, user.ID)
+		cp.sendRpcError(mtproto.ErrSessionPasswordNeeded, msgId, salt, sessionId)
+		return
+	}
+
 	// User exists, create session and return authorization
 	cp.createSessionForUser(user, msgId, salt, sessionId)
 }
@@ -160,33 +368,55 @@ func (cp *ConnProp) HandleAuthSignUp(obj *mtproto.TLAuthSignUp, msgId, salt, ses
 	// Check if already authenticated
 	if cp.userID != 0 {
 		logf(1, "[Conn %d] Already authenticated as user %d\n", cp.connID, cp.userID)
-		user, _ := FindUserByID(cp.userID)
-		if user != nil {
-			cp.createSessionForUser(user, msgId, salt, sessionId)
+		user, err := FindUserByID(cp.userID)
+		if err != nil || user == nil {
+			logf(1, "[Conn %d] Failed to load user %d: %v\n", cp.connID, cp.userID, err)
+			cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+			return
 		}
+		cp.createSessionForUser(user, msgId, salt, sessionId)
 		return
 	}
 
 	// Verify phone code
+	if phoneCodeHash == "" {
+		cp.sendRpcError(mtproto.ErrPhoneCodeHashEmpty, msgId, salt, sessionId)
+		return
+	}
 	phoneCodeDoc, err := FindPhoneCode(phoneCodeHash)
-	if err != nil || phoneCodeDoc == nil {
+	if err != nil {
+		logf(1, "[Conn %d] Failed to find phone code: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	if phoneCodeDoc == nil {
+		// Unknown hashes are treated like codes that already expired and got purged
 		logf(1, "[Conn %d] Invalid phone code hash\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneCodeExpired, msgId, salt, sessionId)
 		return
 	}
 
 	// Verify this phone code belongs to this auth key
 	if phoneCodeDoc.AuthKeyID != cp.authKey.AuthKeyId() {
 		logf(1, "[Conn %d] Phone code auth key mismatch\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneCodeExpired, msgId, salt, sessionId)
 		return
 	}
 
 	if phoneCodeDoc.PhoneNumber != phoneNumber {
 		logf(1, "[Conn %d] Phone number mismatch\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneNumberInvalid, msgId, salt, sessionId)
 		return
 	}
 
 	if !phoneCodeDoc.Verified {
 		logf(1, "[Conn %d] Phone code not verified\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneCodeInvalid, msgId, salt, sessionId)
+		return
+	}
+
+	if firstName == "" {
+		cp.sendRpcError(mtproto.ErrFirstnameInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -194,6 +424,7 @@ func (cp *ConnProp) HandleAuthSignUp(obj *mtproto.TLAuthSignUp, msgId, salt, ses
 	existingUser, _ := FindUserByPhone(phoneNumber)
 	if existingUser != nil {
 		logf(1, "[Conn %d] User already exists\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPhoneNumberOccupied, msgId, salt, sessionId)
 		return
 	}
 
@@ -224,6 +455,7 @@ func (cp *ConnProp) HandleAuthSignUp(obj *mtproto.TLAuthSignUp, msgId, salt, ses
 
 	if err := CreateUser(user); err != nil {
 		logf(1, "[Conn %d] Failed to create user: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
 		return
 	}
 
@@ -235,75 +467,68 @@ func (cp *ConnProp) HandleAuthSignUp(obj *mtproto.TLAuthSignUp, msgId, salt, ses
 
 // Helper: Create session for user and send auth.authorization
 func (cp *ConnProp) createSessionForUser(user *UserDoc, msgId, salt, sessionId int64) {
-	// Create or update session in database
-	session := &SessionDoc{
-		SessionID:  sessionId,
-		AuthKeyID:  cp.authKey.AuthKeyId(),
-		UserID:     user.ID,
-		Salt:       salt,
-		LastUsedAt: time.Now(),
-	}
+	cp.bindUser(user)
+
+	// Send auth.authorization response
+	result := &mtproto.TLAuthAuthorization{Data2: makeAuthAuthorization(user)}
+
+	buf := mtproto.NewEncodeBuf(512)
+	buf.Int(-212046591) // rpc_result constructor
+	buf.Long(msgId)     // original request msg_id
+	result.Encode(buf, cp.encodeLayer())
+	cp.send(buf.GetBuf(), salt, sessionId)
+}
 
-	if err := UpdateSession(session); err != nil {
+// bindUser logs the auth key of the connection in as user.
+func (cp *ConnProp) bindUser(user *UserDoc) {
+	if err := BindSessionUser(cp.userAuthKeyID(), user.ID); err != nil {
 		logf(1, "[Conn %d] Failed to save session: %v\n", cp.connID, err)
 	}
 
 	// Store user ID in connection for future requests
-	cp.userID = user.ID
+	cp.setUserID(user.ID)
 
 	logf(1, "[Conn %d] User logged in: %d (%s)\n", cp.connID, user.ID, user.Phone)
+}
 
-	// Send auth.authorization response
-	result := &mtproto.TLAuthAuthorization{
-		Data2: &mtproto.Auth_Authorization{
-			PredicateName:   "auth_authorization",
-			Constructor:     782418132,
-			FutureAuthToken: nil,
-			User: &mtproto.User{
-				PredicateName: "user",
-				Constructor:   -1885878744,
-				Id:            user.ID,
-				Self:          user.Self,
-				Contact:       user.Contact,
-				MutualContact: user.MutualContact,
-				AccessHash: &wrapperspb.Int64Value{
-					Value: user.AccessHash,
-				},
-				FirstName: &wrapperspb.StringValue{
-					Value: user.FirstName,
-				},
-				LastName: &wrapperspb.StringValue{
-					Value: user.LastName,
-				},
-				Phone: &wrapperspb.StringValue{
-					Value: user.Phone,
-				},
-				Status: &mtproto.UserStatus{
-					PredicateName: "userStatusOnline",
-					Constructor:   -306628279,
-					Expires:       int32(time.Now().Unix() + 3600),
-				},
-				RestrictionReason: nil,
-				Usernames:         nil,
+// makeAuthAuthorization builds the auth.authorization a client gets when it
+// logs in as user.
+func makeAuthAuthorization(user *UserDoc) *mtproto.Auth_Authorization {
+	return &mtproto.Auth_Authorization{
+		PredicateName:   "auth_authorization",
+		Constructor:     782418132,
+		FutureAuthToken: nil,
+		User: &mtproto.User{
+			PredicateName: "user",
+			Constructor:   -1885878744,
+			Id:            user.ID,
+			Self:          user.Self,
+			Contact:       user.Contact,
+			MutualContact: user.MutualContact,
+			AccessHash: &wrapperspb.Int64Value{
+				Value: user.AccessHash,
+			},
+			FirstName: &wrapperspb.StringValue{
+				Value: user.FirstName,
+			},
+			LastName: &wrapperspb.StringValue{
+				Value: user.LastName,
 			},
+			Phone: &wrapperspb.StringValue{
+				Value: user.Phone,
+			},
+			Status: &mtproto.UserStatus{
+				PredicateName: "userStatusOnline",
+				Constructor:   -306628279,
+				Expires:       int32(time.Now().Unix() + 3600),
+			},
+			RestrictionReason: nil,
+			Usernames:         nil,
 		},
 	}
-
-	buf := mtproto.NewEncodeBuf(512)
-	buf.Int(-212046591) // rpc_result constructor
-	buf.Long(msgId)     // original request msg_id
-	result.Encode(buf, 158)
-	cp.send(buf.GetBuf(), salt, sessionId)
 }
 
 
-// Helper: Generate verification code (static for testing)
-func generateVerificationCode(length int) string {
-	// TODO: In production, generate random code and send via SMS
-	// For now, always return "12345" for testing
-	return "12345"
-}
-
 // Helper: Generate user ID
 // func generateUserID() int64 {
 // 	n, _ := rand.Int(rand.Reader, big.NewInt(9000000000))
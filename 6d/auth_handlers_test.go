@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+func TestNextCodeType(t *testing.T) {
+	tests := []struct {
+		codeType string
+		want     string
+	}{
+		{"auth_sentCodeTypeApp", "auth_sentCodeTypeSms"},
+		{"auth_sentCodeTypeSms", ""},
+		{"auth_sentCodeTypeCall", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := nextCodeType(tt.codeType); got != tt.want {
+			t.Errorf("nextCodeType(%q) = %q, want %q", tt.codeType, got, tt.want)
+		}
+	}
+}
+
+func TestResendFloodWait(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		sentAt time.Time
+		want   int32
+	}{
+		{"just sent", now, 60},
+		{"half a second ago", now.Add(-500 * time.Millisecond), 60},
+		{"59.5 seconds ago", now.Add(-59500 * time.Millisecond), 1},
+		{"a minute ago", now.Add(-resendCodeInterval), 0},
+		{"long ago", now.Add(-time.Hour), 0},
+	}
+	for _, tt := range tests {
+		if got := resendFloodWait(tt.sentAt, now); got != tt.want {
+			t.Errorf("%s: resendFloodWait = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// testPhoneCode saves a phone code sent by codeType at sentAt.
+func testPhoneCode(t *testing.T, codeType string, sentAt time.Time) string {
+	hash := crypto.GenerateStringNonce(16)
+	if err := SavePhoneCode(&PhoneCodeDoc{
+		PhoneNumber:   "99966" + hash[:5],
+		PhoneCodeHash: hash,
+		Code:          "12345",
+		CodeType:      codeType,
+		SentAt:        sentAt,
+		ExpiresAt:     time.Now().Add(phoneCodeTTL),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeletePhoneCode(hash) })
+	return hash
+}
+
+func TestClaimPhoneCodeResend(t *testing.T) {
+	testMongo(t)
+	due := time.Now().Add(-resendCodeInterval)
+	tests := []struct {
+		name     string
+		codeType string
+		sentAt   time.Time
+		want     bool
+	}{
+		{"due", "auth_sentCodeTypeApp", due.Add(-time.Second), true},
+		{"too early", "auth_sentCodeTypeApp", time.Now(), false},
+		{"already resent", "auth_sentCodeTypeSms", due.Add(-time.Second), false},
+	}
+	for _, tt := range tests {
+		hash := testPhoneCode(t, tt.codeType, tt.sentAt)
+		claimed, err := ClaimPhoneCodeResend(hash, "auth_sentCodeTypeApp", "auth_sentCodeTypeSms", due)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != tt.want {
+			t.Errorf("%s: claimed = %v, want %v", tt.name, claimed, tt.want)
+		}
+		// A concurrent resend of the same code loses
+		if claimed, _ := ClaimPhoneCodeResend(hash, "auth_sentCodeTypeApp", "auth_sentCodeTypeSms", due); claimed {
+			t.Errorf("%s: claimed twice", tt.name)
+		}
+	}
+}
+
+func TestRecordPhoneCodeAttempt(t *testing.T) {
+	testMongo(t)
+	hash := testPhoneCode(t, "auth_sentCodeTypeSms", time.Now())
+	for want := 1; want <= maxPhoneCodeAttempts; want++ {
+		got, err := RecordPhoneCodeAttempt(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("attempt %d counted as %d", want, got)
+		}
+	}
+	if _, err := RecordPhoneCodeAttempt("missing" + hash); err == nil {
+		t.Error("attempt on an unknown hash succeeded")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+// authKeyMissTTL is how long an auth_key_id unknown to the database is
+// remembered as unknown before MongoDB is asked again.
+const authKeyMissTTL = time.Minute
+
+// authKeyCacheSize is the number of auth keys kept in memory
+// (AUTH_KEY_CACHE_SIZE, default 10000). Unknown ids count towards it too.
+var authKeyCacheSize = func() int {
+	if envVal := os.Getenv("AUTH_KEY_CACHE_SIZE"); envVal != "" {
+		if size, err := strconv.Atoi(envVal); err == nil && size > 0 {
+			return size
+		}
+	}
+	return 10000
+}()
+
+// authKeyInfo is an auth key with what the server knows about it.
+type authKeyInfo struct {
+	key           *crypto.AuthKey
+	temp          bool
+	media         bool
+	expiresAt     time.Time // Zero for permanent keys
+	permAuthKeyID int64     // Permanent key a temp key is bound to, 0 if unbound
+}
+
+func newAuthKeyInfo(doc *AuthKeyDoc) *authKeyInfo {
+	return &authKeyInfo{
+		key:           crypto.NewAuthKey(doc.AuthKeyID, doc.AuthKey),
+		temp:          doc.Temp,
+		media:         doc.Media,
+		expiresAt:     doc.ExpiresAt,
+		permAuthKeyID: doc.PermAuthKeyID,
+	}
+}
+
+// expired reports whether a temp key can no longer be used.
+func (i *authKeyInfo) expired(now time.Time) bool {
+	return i != nil && !i.expiresAt.IsZero() && !now.Before(i.expiresAt)
+}
+
+// userAuthKeyID returns the auth key the user's session belongs to: the
+// permanent key a temp key is bound to, else the connection's own key.
+func (cp *ConnProp) userAuthKeyID() int64 {
+	if cp.keyInfo != nil && cp.keyInfo.permAuthKeyID != 0 {
+		return cp.keyInfo.permAuthKeyID
+	}
+	return cp.authKey.AuthKeyId()
+}
+
+type authKeyEntry struct {
+	authKeyID int64
+	info      *authKeyInfo // nil: not in the database
+	expires   time.Time    // Only for misses
+}
+
+// authKeyCache is an LRU cache of auth keys in front of MongoDB.
+type authKeyCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Most recently used first, values are *authKeyEntry
+	entries map[int64]*list.Element
+}
+
+var authKeys = &authKeyCache{
+	size:    authKeyCacheSize,
+	order:   list.New(),
+	entries: make(map[int64]*list.Element),
+}
+
+// get returns the cached entry for authKeyID, if any and not expired.
+func (c *authKeyCache) get(authKeyID int64) (*authKeyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[authKeyID]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*authKeyEntry)
+	now := time.Now()
+	if e.info == nil && now.After(e.expires) || e.info != nil && e.info.expired(now) {
+		c.order.Remove(el)
+		delete(c.entries, authKeyID)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e, true
+}
+
+// put caches info (nil for a miss) under authKeyID, evicting the least
+// recently used entry when full.
+func (c *authKeyCache) put(authKeyID int64, info *authKeyInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &authKeyEntry{authKeyID: authKeyID, info: info}
+	if info == nil {
+		e.expires = time.Now().Add(authKeyMissTTL)
+	}
+	if el, ok := c.entries[authKeyID]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[authKeyID] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*authKeyEntry).authKeyID)
+	}
+}
+
+// remove forgets authKeyID, e.g. after the key was destroyed.
+func (c *authKeyCache) remove(authKeyID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[authKeyID]; ok {
+		c.order.Remove(el)
+		delete(c.entries, authKeyID)
+	}
+}
+
+// lookupAuthKey resolves an auth_key_id through the cache. It returns nil
+// without error for keys the database does not know and expired temp keys.
+func lookupAuthKey(authKeyID int64) (*authKeyInfo, error) {
+	if e, ok := authKeys.get(authKeyID); ok {
+		return e.info, nil
+	}
+	doc, err := LoadAuthKeyByID(authKeyID)
+	if err != nil {
+		// Don't cache database failures as misses
+		return nil, err
+	}
+	var info *authKeyInfo
+	if doc != nil {
+		info = newAuthKeyInfo(doc)
+		if info.expired(time.Now()) {
+			info = nil
+		}
+	}
+	authKeys.put(authKeyID, info)
+	return info, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+func newTestAuthKeyCache(size int) *authKeyCache {
+	return &authKeyCache{size: size, order: list.New(), entries: make(map[int64]*list.Element)}
+}
+
+func testAuthKeyInfo(authKeyID int64) *authKeyInfo {
+	return &authKeyInfo{key: crypto.NewAuthKey(authKeyID, crypto.GenerateNonce(256))}
+}
+
+func TestAuthKeyCacheEviction(t *testing.T) {
+	c := newTestAuthKeyCache(3)
+	c.put(1, testAuthKeyInfo(1))
+	c.put(2, testAuthKeyInfo(2))
+	c.put(3, nil)
+	c.get(1)                     // 2 is now the least recently used
+	c.put(4, testAuthKeyInfo(4)) // Evicts 2
+	c.put(3, testAuthKeyInfo(3)) // Replaces the miss without evicting
+	c.remove(4)
+
+	tests := []struct {
+		authKeyID int64
+		wantFound bool
+		wantKey   bool
+	}{
+		{1, true, true},
+		{2, false, false},
+		{3, true, true},
+		{4, false, false},
+		{5, false, false},
+	}
+	for _, tt := range tests {
+		e, found := c.get(tt.authKeyID)
+		if found != tt.wantFound {
+			t.Errorf("get(%d) found = %v, want %v", tt.authKeyID, found, tt.wantFound)
+			continue
+		}
+		if found && (e.info != nil) != tt.wantKey {
+			t.Errorf("get(%d) has key = %v, want %v", tt.authKeyID, e.info != nil, tt.wantKey)
+		}
+	}
+	if c.order.Len() != len(c.entries) || c.order.Len() != 2 {
+		t.Errorf("%d entries in the list and %d in the map, want 2", c.order.Len(), len(c.entries))
+	}
+}
+
+func TestAuthKeyCacheMissExpires(t *testing.T) {
+	c := newTestAuthKeyCache(10)
+	c.put(1, nil)
+	if e, ok := c.get(1); !ok || e.info != nil {
+		t.Fatal("miss not cached")
+	}
+
+	c.entries[1].Value.(*authKeyEntry).expires = time.Now().Add(-time.Second)
+	if _, ok := c.get(1); ok {
+		t.Error("expired miss still cached")
+	}
+	if _, ok := c.entries[1]; ok {
+		t.Error("expired miss not dropped")
+	}
+}
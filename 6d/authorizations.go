@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+// authorizationTtlDays is reported to clients as the inactivity period after
+// which authorizations are terminated.
+const authorizationTtlDays = 180
+
+// clientIP returns the remote address of the connection without the port.
+func (cp *ConnProp) clientIP() string {
+	host, _, err := net.SplitHostPort(cp.conn.RemoteAddr().String())
+	if err != nil {
+		return cp.conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// saveClientInfo persists the metadata the client sent with initConnection.
+func (cp *ConnProp) saveClientInfo(ic *mtproto.TLInitConnection, layer int32) {
+	session := &SessionDoc{
+		AuthKeyID:      cp.userAuthKeyID(),
+		ApiID:          ic.ApiId,
+		DeviceModel:    ic.DeviceModel,
+		SystemVersion:  ic.SystemVersion,
+		AppVersion:     ic.AppVersion,
+		SystemLangCode: ic.SystemLangCode,
+		LangPack:       ic.LangPack,
+		LangCode:       ic.LangCode,
+		Layer:          layer,
+		ClientIP:       cp.clientIP(),
+	}
+	go func() {
+		if err := SaveSessionClientInfo(session); err != nil {
+			logf(1, "[Conn %d] Failed to save client info: %v\n", cp.connID, err)
+		}
+	}()
+}
+
+// logOutAuthKey unbinds an auth key from its user, in the database and on
+// every live connection using it. Those connections get AUTH_KEY_UNREGISTERED
+// from now on; all but except are also sent updatesTooLong, so their clients
+// call updates.getDifference right away and find out.
+func logOutAuthKey(authKeyID int64, except *ConnProp) error {
+	if err := ClearSessionUser(authKeyID); err != nil {
+		return err
+	}
+	logOutConnections(authKeyID, except)
+	return nil
+}
+
+// logOutConnections is the in-memory half of logOutAuthKey.
+func logOutConnections(authKeyID int64, except *ConnProp) {
+	activeConnections.Range(func(_, v interface{}) bool {
+		cp := v.(*ConnProp)
+		if _, id := cp.identity(); id == 0 || id != authKeyID {
+			return true
+		}
+		logf(1, "[Conn %d] Auth key %d logged out\n", cp.connID, authKeyID)
+		if cp == except {
+			cp.setUserID(0)
+			return true
+		}
+		// Other connections run on their own goroutines and drop userID
+		// before their next message
+		cp.mu.Lock()
+		cp.loggedOut = true
+		sessionID := cp.sessionID
+		cp.mu.Unlock()
+		if sessionID != 0 {
+			cp.pushUpdates(mtproto.MakeTLUpdatesTooLong(nil))
+		}
+		return true
+	})
+}
+
+// HandleAuthLogOut handles TL_auth_logOut requests
+func (cp *ConnProp) HandleAuthLogOut(obj *mtproto.TLAuthLogOut, msgId, salt, sessionId int64) {
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+
+	userID, authKeyID := cp.userID, cp.userAuthKeyID()
+	if err := logOutAuthKey(authKeyID, cp); err != nil {
+		logf(1, "[Conn %d] Failed to log out: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	logf(1, "[Conn %d] User %d logged out of auth key %d\n", cp.connID, userID, authKeyID)
+
+	result := mtproto.MakeTLAuthLoggedOut(&mtproto.Auth_LoggedOut{})
+	cp.encodeAndSend(result, msgId, salt, sessionId, 64)
+}
+
+// authorizationHash identifies a session in account.authorizations. It is
+// random, the auth_key_id a device uses to look up its key is never shown to
+// other devices. The current session always has hash 0.
+func authorizationHash(session *SessionDoc) int64 {
+	if session.AuthHash == 0 {
+		hash, err := SessionAuthHash(session.AuthKeyID)
+		if err != nil {
+			logf(1, "Failed to get authorization hash of auth key %d: %v\n", session.AuthKeyID, err)
+		}
+		session.AuthHash = hash
+	}
+	return session.AuthHash
+}
+
+// makeAuthorization describes session as an entry of account.authorizations.
+func makeAuthorization(s *SessionDoc, current bool) *mtproto.Authorization {
+	return &mtproto.Authorization{
+		PredicateName: "authorization",
+		Constructor:   -1392388579,
+		Current:       current,
+		Hash:          authorizationHash(s),
+		DeviceModel:   s.DeviceModel,
+		Platform:      s.LangPack,
+		SystemVersion: s.SystemVersion,
+		ApiId:         s.ApiID,
+		AppName:       "Telegram",
+		AppVersion:    s.AppVersion,
+		DateCreated:   int32(s.CreatedAt.Unix()),
+		DateActive:    int32(s.LastUsedAt.Unix()),
+		Ip:            s.ClientIP,
+	}
+}
+
+// HandleAccountGetAuthorizations handles TL_account_getAuthorizations requests
+func (cp *ConnProp) HandleAccountGetAuthorizations(obj *mtproto.TLAccountGetAuthorizations, msgId, salt, sessionId int64) {
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+
+	sessions, err := FindSessionsByUser(cp.userID)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to load authorizations: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+
+	current := cp.userAuthKeyID()
+	authorizations := make([]*mtproto.Authorization, 0, len(sessions))
+	for i := range sessions {
+		a := makeAuthorization(&sessions[i], sessions[i].AuthKeyID == current)
+		if a.Current {
+			a.Hash = 0
+			authorizations = append([]*mtproto.Authorization{a}, authorizations...)
+		} else {
+			authorizations = append(authorizations, a)
+		}
+	}
+	logf(1, "[Conn %d] account.getAuthorizations: %d authorization(s) of user %d\n", cp.connID, len(authorizations), cp.userID)
+
+	result := &mtproto.TLAccountAuthorizations{
+		Data2: &mtproto.Account_Authorizations{
+			PredicateName:        "account_authorizations",
+			Constructor:          1275039392,
+			AuthorizationTtlDays: authorizationTtlDays,
+			Authorizations:       authorizations,
+		},
+	}
+	cp.encodeAndSend(result, msgId, salt, sessionId, 1024)
+}
+
+// HandleAccountResetAuthorization handles TL_account_resetAuthorization requests
+func (cp *ConnProp) HandleAccountResetAuthorization(obj *mtproto.TLAccountResetAuthorization, msgId, salt, sessionId int64) {
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+	// The current session is logged out with auth.logOut instead
+	if obj.GetHash() == 0 {
+		cp.sendRpcError(mtproto.ErrHashInvalid, msgId, salt, sessionId)
+		return
+	}
+
+	sessions, err := FindSessionsByUser(cp.userID)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to load authorizations: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+
+	current := cp.userAuthKeyID()
+	for i := range sessions {
+		s := &sessions[i]
+		if s.AuthKeyID == current || authorizationHash(s) != obj.GetHash() {
+			continue
+		}
+		if err := logOutAuthKey(s.AuthKeyID, cp); err != nil {
+			logf(1, "[Conn %d] Failed to reset authorization: %v\n", cp.connID, err)
+			cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+			return
+		}
+		logf(1, "[Conn %d] User %d reset authorization of auth key %d\n", cp.connID, cp.userID, s.AuthKeyID)
+		cp.encodeAndSend(mtproto.MakeTLBoolTrue(nil), msgId, salt, sessionId, 64)
+		return
+	}
+	cp.sendRpcError(mtproto.ErrHashInvalid, msgId, salt, sessionId)
+}
+
+// HandleAuthResetAuthorizations handles TL_auth_resetAuthorizations requests by
+// logging out every other session of the user
+func (cp *ConnProp) HandleAuthResetAuthorizations(obj *mtproto.TLAuthResetAuthorizations, msgId, salt, sessionId int64) {
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+
+	sessions, err := FindSessionsByUser(cp.userID)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to load authorizations: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+
+	current := cp.userAuthKeyID()
+	reset := 0
+	for i := range sessions {
+		if sessions[i].AuthKeyID == current {
+			continue
+		}
+		if err := logOutAuthKey(sessions[i].AuthKeyID, cp); err != nil {
+			logf(1, "[Conn %d] Failed to reset authorization: %v\n", cp.connID, err)
+			cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+			return
+		}
+		reset++
+	}
+	logf(1, "[Conn %d] User %d reset %d other authorization(s)\n", cp.connID, cp.userID, reset)
+	cp.encodeAndSend(mtproto.MakeTLBoolTrue(nil), msgId, salt, sessionId, 64)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+// testConn registers a connection using authKeyID, logged in as userID, and
+// unregisters it when the test ends. It has no session, so nothing is pushed
+// to it.
+func testConn(t *testing.T, connID int, authKeyID, permAuthKeyID, userID int64) *ConnProp {
+	cp := &ConnProp{connID: connID}
+	cp.setAuthKey(&authKeyInfo{
+		key:           crypto.NewAuthKey(authKeyID, crypto.GenerateNonce(256)),
+		permAuthKeyID: permAuthKeyID,
+	}, userID)
+	activeConnections.Store(connID, cp)
+	t.Cleanup(func() { activeConnections.Delete(connID) })
+	return cp
+}
+
+func TestLogOutConnections(t *testing.T) {
+	caller := testConn(t, -1, 100, 0, 10)
+	sameKey := testConn(t, -2, 200, 0, 10)
+	boundTemp := testConn(t, -3, 201, 200, 10)
+	otherKey := testConn(t, -4, 300, 0, 10)
+
+	logOutConnections(200, caller)
+
+	tests := []struct {
+		name     string
+		cp       *ConnProp
+		wantUser int64
+	}{
+		{"caller", caller, 10},
+		{"same auth key", sameKey, 0},
+		{"temp key bound to it", boundTemp, 0},
+		{"other auth key", otherKey, 10},
+	}
+	for _, tt := range tests {
+		// The dispatcher sees the log out at once
+		if userID, _ := tt.cp.identity(); userID != tt.wantUser {
+			t.Errorf("%s: identity user = %d, want %d", tt.name, userID, tt.wantUser)
+		}
+		// The connection itself before its next message
+		tt.cp.applyLogOut()
+		if tt.cp.userID != tt.wantUser {
+			t.Errorf("%s: userID = %d after applyLogOut, want %d", tt.name, tt.cp.userID, tt.wantUser)
+		}
+	}
+
+	// The caller logging out its own key drops the user right away
+	logOutConnections(100, caller)
+	if caller.userID != 0 {
+		t.Errorf("caller: userID = %d after logging out its own key, want 0", caller.userID)
+	}
+}
+
+var mongoOnce sync.Once
+
+// testMongo connects to the MongoDB at MONGO_TEST_URL, or skips the test if
+// it is not set. Tests use random auth key ids and clean up after themselves.
+func testMongo(t *testing.T) {
+	url := os.Getenv("MONGO_TEST_URL")
+	if url == "" {
+		t.Skip("MONGO_TEST_URL not set")
+	}
+	var err error
+	mongoOnce.Do(func() { err = InitMongoDB(url) })
+	if err != nil || sessionsCollection == nil {
+		t.Fatalf("connect to MongoDB: %v", err)
+	}
+}
+
+// loggedInTestConn is a connection with a fresh auth key that is logged in as
+// userID in the database. Its outgoing messages stay queued.
+func loggedInTestConn(t *testing.T, connID int, userID int64) *ConnProp {
+	authKeyID := GenerateAccessHash()
+	cp := testConn(t, connID, authKeyID, 0, userID)
+	setInitialServerSalt(authKeyID, randomSalt())
+	if err := BindSessionUser(authKeyID, userID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeleteAuthKey(authKeyID) })
+	cp.beginBatch()
+	return cp
+}
+
+// sendTestQuery has cp receive body as a content-related client message.
+func sendTestQuery(t *testing.T, cp *ConnProp, sessionId int64, seqNo int32, body []byte) {
+	time.Sleep(time.Millisecond) // Distinct msg_ids
+	authKeyID := cp.authKey.AuthKeyId()
+	p := make([]byte, 32, 32+len(body)+16)
+	binary.LittleEndian.PutUint64(p[0:8], uint64(currentServerSalt(authKeyID)))
+	binary.LittleEndian.PutUint64(p[8:16], uint64(sessionId))
+	binary.LittleEndian.PutUint64(p[16:24], uint64(clientMsgId(time.Now(), int64(time.Now().Nanosecond())&^3)))
+	binary.LittleEndian.PutUint32(p[24:28], uint32(seqNo))
+	binary.LittleEndian.PutUint32(p[28:32], uint32(len(body)))
+	p = append(p, body...)
+	p = append(p, make([]byte, 16+(16-len(p)%16)%16)...)
+	if err := cp.handleAuthenticated(encryptTestMessage(t, cp.authKey, p)); err != nil {
+		t.Fatalf("handleAuthenticated: %v", err)
+	}
+}
+
+func pingBody() []byte {
+	buf := mtproto.NewEncodeBuf(16)
+	buf.Int(0x7abe77ec) // ping
+	buf.Long(1)
+	return buf.GetBuf()
+}
+
+// waitSessionUser waits until the session of authKeyID recorded sessionId and
+// returns the user it is bound to.
+func waitSessionUser(t *testing.T, authKeyID, sessionId int64) int64 {
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		session, err := FindSessionByAuthKey(authKeyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session != nil && session.SessionID == sessionId {
+			return session.UserID
+		}
+	}
+	t.Fatalf("session %d of auth key %d was not recorded", sessionId, authKeyID)
+	return 0
+}
+
+func TestResetAuthorizationSurvivesNextMessage(t *testing.T) {
+	testMongo(t)
+	const userID = 1 << 40
+	reset := loggedInTestConn(t, -10, userID)
+	authKeyID := reset.authKey.AuthKeyId()
+
+	// Another session of the user terminates this one
+	if err := logOutAuthKey(authKeyID, nil); err != nil {
+		t.Fatal(err)
+	}
+	sendTestQuery(t, reset, 77, 1, pingBody())
+
+	if got := waitSessionUser(t, authKeyID, 77); got != 0 {
+		t.Errorf("session is bound to user %d after its next message, want 0", got)
+	}
+	if reset.userID != 0 {
+		t.Errorf("connection still logged in as %d", reset.userID)
+	}
+}
+
+func TestAuthLogOutSurvivesNextMessage(t *testing.T) {
+	testMongo(t)
+	const userID = 1<<40 + 1
+	cp := loggedInTestConn(t, -11, userID)
+	authKeyID := cp.authKey.AuthKeyId()
+
+	logOut := mtproto.NewEncodeBuf(4)
+	logOut.Int(0x3e72ba19) // auth.logOut
+	sendTestQuery(t, cp, 78, 1, logOut.GetBuf())
+	if cp.userID != 0 {
+		t.Fatalf("connection still logged in as %d after auth.logOut", cp.userID)
+	}
+	// What the client does next, e.g. updates.getState
+	sendTestQuery(t, cp, 78, 3, pingBody())
+
+	if got := waitSessionUser(t, authKeyID, 78); got != 0 {
+		t.Errorf("session is bound to user %d after auth.logOut, want 0", got)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// CodeSender delivers login codes to the owner of a phone number.
+type CodeSender interface {
+	// SendCode delivers code to phone. It returns false without an error if
+	// the user can't be reached this way, so the next sender is tried.
+	SendCode(phone, code string) (bool, error)
+	// SentCodeType describes the delivery to the client in auth.sentCode.
+	SentCodeType(length int) *mtproto.Auth_SentCodeType
+}
+
+// verificationCodeLength is the number of digits of login codes
+// (VERIFICATION_CODE_LENGTH, default 5).
+var verificationCodeLength = func() int {
+	length := envLimit("VERIFICATION_CODE_LENGTH", 5)
+	if length < 4 || length > 10 {
+		log.Fatalf("VERIFICATION_CODE_LENGTH must be between 4 and 10, not %d", length)
+	}
+	return length
+}()
+
+// testPhoneCodes maps test phone numbers to their fixed codes, from
+// TEST_PHONE_CODES ("phone=code,phone=code"). Their codes are not delivered.
+var testPhoneCodes = func() map[string]string {
+	codes := make(map[string]string)
+	envVal := os.Getenv("TEST_PHONE_CODES")
+	if envVal == "" {
+		return codes
+	}
+	for _, entry := range strings.Split(envVal, ",") {
+		phone, code, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || phone == "" || code == "" {
+			log.Fatalf("Invalid TEST_PHONE_CODES entry: %q", entry)
+		}
+		codes[phone] = code
+	}
+	return codes
+}()
+
+// smsCodeSender is the SMS stub: CODE_WEBHOOK_URL, CODE_FILE or else the
+// server log. auth.resendCode always uses it.
+var smsCodeSender = func() CodeSender {
+	switch {
+	case os.Getenv("CODE_WEBHOOK_URL") != "":
+		return newWebhookCodeSender(os.Getenv("CODE_WEBHOOK_URL"))
+	case os.Getenv("CODE_FILE") != "":
+		return &fileCodeSender{path: os.Getenv("CODE_FILE")}
+	default:
+		return logCodeSender{}
+	}
+}()
+
+// codeSenders are tried in order by auth.sendCode until one reaches the
+// user: the user's other sessions (unless CODE_APP_DELIVERY=0), then SMS.
+var codeSenders = func() []CodeSender {
+	var senders []CodeSender
+	if os.Getenv("CODE_APP_DELIVERY") != "0" {
+		senders = append(senders, appCodeSender{})
+	}
+	return append(senders, smsCodeSender)
+}()
+
+// generateVerificationCode returns a random code of length digits.
+func generateVerificationCode(length int) string {
+	digits := make([]byte, length)
+	for i := range digits {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			panic(err)
+		}
+		digits[i] = byte('0' + n.Int64())
+	}
+	return string(digits)
+}
+
+// deliverCode sends code through the first of senders that reaches the
+// owner of phone and returns how it was sent.
+func deliverCode(senders []CodeSender, phone, code string) (*mtproto.Auth_SentCodeType, error) {
+	for _, sender := range senders {
+		delivered, err := sender.SendCode(phone, code)
+		if err != nil {
+			logf(1, "%T failed to deliver code to %s: %v\n", sender, phone, err)
+			continue
+		}
+		if delivered {
+			return sender.SentCodeType(len(code)), nil
+		}
+	}
+	return nil, fmt.Errorf("no code sender reached %s", phone)
+}
+
+func sentCodeTypeSms(length int) *mtproto.Auth_SentCodeType {
+	return &mtproto.Auth_SentCodeType{
+		PredicateName: "auth_sentCodeTypeSms",
+		Constructor:   -1073693790,
+		Length:        int32(length),
+	}
+}
+
+// appCodeSender posts the code as a service notification to the live
+// sessions the user already has on other devices.
+type appCodeSender struct{}
+
+func (appCodeSender) SendCode(phone, code string) (bool, error) {
+	user, err := FindUserByPhone(phone)
+	if err != nil || user == nil {
+		return false, err
+	}
+	now := int32(time.Now().Unix())
+	update := &mtproto.Update{
+		PredicateName:  "updateServiceNotification",
+		Constructor:    -337352679,
+		InboxDate:      &wrapperspb.Int32Value{Value: now},
+		Type:           fmt.Sprintf("auth%d_%d", user.ID, now),
+		Message_STRING: fmt.Sprintf("Login code: %s. Do not give this code to anyone, even if they say they are from Telegram!", code),
+		Media: &mtproto.MessageMedia{
+			PredicateName: "messageMediaEmpty",
+			Constructor:   1038967584,
+		},
+		Entities: []*mtproto.MessageEntity{},
+	}
+	return pushUpdatesToUser(user.ID, makeUpdatesEnvelope(update), nil) > 0, nil
+}
+
+func (appCodeSender) SentCodeType(length int) *mtproto.Auth_SentCodeType {
+	return &mtproto.Auth_SentCodeType{
+		PredicateName: "auth_sentCodeTypeApp",
+		Constructor:   1035688326,
+		Length:        int32(length),
+	}
+}
+
+// fileCodeSender stands in for SMS by appending "phone code" lines to a file.
+type fileCodeSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *fileCodeSender) SendCode(phone, code string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", phone, code); err != nil {
+		f.Close()
+		return false, err
+	}
+	return true, f.Close()
+}
+
+func (s *fileCodeSender) SentCodeType(length int) *mtproto.Auth_SentCodeType {
+	return sentCodeTypeSms(length)
+}
+
+const (
+	// webhookTimeout bounds a single webhook request
+	webhookTimeout = 5 * time.Second
+	// webhookWorkers is the number of webhook requests in flight at once
+	webhookWorkers = 4
+	// webhookQueueSize is how many codes may wait for a worker before
+	// SendCode fails
+	webhookQueueSize = 256
+)
+
+// webhookCodeSender stands in for SMS by POSTing {"phone", "code"} as JSON.
+// Like an SMS gateway it only queues the code, so a slow webhook never holds
+// up the connection that asked for it.
+type webhookCodeSender struct {
+	url    string
+	client *http.Client
+	queue  chan codeDelivery
+}
+
+type codeDelivery struct {
+	phone, code string
+}
+
+func newWebhookCodeSender(url string) *webhookCodeSender {
+	s := &webhookCodeSender{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan codeDelivery, webhookQueueSize),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go s.run()
+	}
+	return s
+}
+
+func (s *webhookCodeSender) SendCode(phone, code string) (bool, error) {
+	select {
+	case s.queue <- codeDelivery{phone, code}:
+		return true, nil
+	default:
+		return false, fmt.Errorf("webhook queue is full")
+	}
+}
+
+func (s *webhookCodeSender) run() {
+	for d := range s.queue {
+		if err := s.post(d.phone, d.code); err != nil {
+			logf(1, "Webhook failed to deliver code to %s: %v\n", d.phone, err)
+		}
+	}
+}
+
+func (s *webhookCodeSender) post(phone, code string) error {
+	body, _ := json.Marshal(map[string]string{"phone": phone, "code": code})
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookCodeSender) SentCodeType(length int) *mtproto.Auth_SentCodeType {
+	return sentCodeTypeSms(length)
+}
+
+// logCodeSender only logs the code, for development without any stub.
+type logCodeSender struct{}
+
+func (logCodeSender) SendCode(phone, code string) (bool, error) {
+	log.Printf("Verification code for %s: %s", phone, code)
+	return true, nil
+}
+
+func (logCodeSender) SentCodeType(length int) *mtproto.Auth_SentCodeType {
+	return sentCodeTypeSms(length)
+}
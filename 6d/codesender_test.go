@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookCodeSender(t *testing.T) {
+	received := make(chan map[string]string, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // A slow webhook
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	s := newWebhookCodeSender(srv.URL)
+	start := time.Now()
+	delivered, err := s.SendCode("15550001", "12345")
+	if !delivered || err != nil {
+		t.Fatalf("SendCode = %v, %v", delivered, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SendCode waited %v for the webhook", elapsed)
+	}
+
+	release <- struct{}{}
+	select {
+	case body := <-received:
+		if body["phone"] != "15550001" || body["code"] != "12345" {
+			t.Errorf("webhook got %v", body)
+		}
+	case <-time.After(webhookTimeout):
+		t.Fatal("webhook was not called")
+	}
+}
+
+func TestWebhookCodeSenderQueueFull(t *testing.T) {
+	// No workers, so nothing leaves the queue
+	s := &webhookCodeSender{queue: make(chan codeDelivery, 2)}
+	for i, want := range []bool{true, true, false} {
+		delivered, err := s.SendCode("15550001", "12345")
+		if delivered != want || (err != nil) == want {
+			t.Errorf("code %d: SendCode = %v, %v, want %v", i, delivered, err, want)
+		}
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"math/big"
 	"time"
 
-	"github.com/teamgram/marmota/pkg/hack"
 	"github.com/teamgram/proto/mtproto"
 	"github.com/teamgram/proto/mtproto/crypto"
 	"google.golang.org/protobuf/types/known/wrapperspb"
@@ -57,152 +56,10 @@ func serializeToBuffer(x *mtproto.EncodeBuf, msgId int64, obj mtproto.TLObject)
 	return nil
 }
 
-func (cp *ConnProp) sendHandshakeRes(obj mtproto.TLObject) { cp.conn.Write(cp.encode(obj)) }
-
-var (
-	cryptoCodec *AesCTR128Crypto
-)
-
-func initializeCTRCodec(buffer []byte, n int) *AesCTR128Crypto {
-	encrypted := buffer[:n]
-	obfuscatedBuf := encrypted[:64]
-	var tmp [64]byte
-	for i := 0; i < 48; i++ { tmp[i] = obfuscatedBuf[55-i] }
-	encryptor, _ := crypto.NewAesCTR128Encrypt(tmp[:32], tmp[32:48])
-	decryptor, _ := crypto.NewAesCTR128Encrypt(obfuscatedBuf[8:40], obfuscatedBuf[40:56])
-	cryptoCodec = newAesCTR128Crypto(decryptor, encryptor)
-	return cryptoCodec
-}
-
-func handleReqDHParams(cp *ConnProp, obj mtproto.TLObject) ([]byte, []byte, []byte, []byte, error) {
-	reqDhParam, _ := obj.(*mtproto.TLReq_DHParams)
-	rsa, _ := crypto.NewRSACryptor("./server_pkcs1.key")
-	innerData := rsa.Decrypt([]byte(reqDhParam.EncryptedData))
-	key := innerData[:32]
-	hash := crypto.Sha256Digest(innerData[32:])
-	for i := 0; i < 32; i++ { key[i] = key[i] ^ hash[i] }
-	hashPadded, _ := crypto.NewAES256IGECryptor(key, zeroIV).Decrypt(innerData[32:])
-	for i, j := 0, 191; i < j; i, j = i+1, j-1 { hashPadded[i], hashPadded[j] = hashPadded[j], hashPadded[i] }
-	dbuf := mtproto.NewDecodeBuf(hashPadded)
-	o := dbuf.Object()
-	var (
-		handshakeType int
-		expiresIn     int32
-		pqInnerData   *mtproto.P_QInnerData
-	)
-	switch innerData := o.(type) {
-	case *mtproto.TLPQInnerData:
-		handshakeType = mtproto.AuthKeyTypePerm
-		pqInnerData = innerData.To_P_QInnerData()
-	case *mtproto.TLPQInnerDataDc:
-		handshakeType = mtproto.AuthKeyTypePerm
-		pqInnerData = innerData.To_P_QInnerData()
-	case *mtproto.TLPQInnerDataTemp:
-		handshakeType = mtproto.AuthKeyTypeTemp
-		expiresIn = innerData.GetExpiresIn()
-		pqInnerData = innerData.To_P_QInnerData()
-	case *mtproto.TLPQInnerDataTempDc:
-		if innerData.GetDc() < 0 {
-			handshakeType = mtproto.AuthKeyTypeMediaTemp
-		} else {
-			handshakeType = mtproto.AuthKeyTypeTemp
-		}
-		expiresIn = innerData.GetExpiresIn()
-		pqInnerData = innerData.To_P_QInnerData()
-	default:
-		return nil, nil, nil, nil, fmt.Errorf("onReq_DHParams - decode P_Q_inner_data error")
-	}
-	newNonce := pqInnerData.GetNewNonce()
-	A := crypto.GenerateNonce(256)
-	bigIntA := new(big.Int).SetBytes(A)
-	gA := new(big.Int).Exp(gBigIntDH2048G, bigIntA, gBigIntDH2048P)
-	serverDHInnerData := &mtproto.TLServer_DHInnerData{Data2: &mtproto.Server_DHInnerData{Constructor: mtproto.TLConstructor(mtproto.TLConstructor_CRC32_server_DH_inner_data), Nonce: reqDhParam.Nonce, ServerNonce: reqDhParam.ServerNonce, G: int32(dh2048G[0]), GA: string(gA.Bytes()), DhPrime: string(dh2048P), ServerTime: int32(time.Now().Unix())}}
+func (cp *ConnProp) sendHandshakeRes(obj mtproto.TLObject) {
 	x := mtproto.NewEncodeBuf(512)
-	serverDHInnerData.Encode(x, 0)
-	serverDHInnerDataBuf := x.GetBuf()
-	tmpAesKeyAndIV := make([]byte, 64)
-	sha1A := sha1.Sum(append(newNonce, reqDhParam.ServerNonce...))
-	sha1B := sha1.Sum(append(reqDhParam.ServerNonce, newNonce...))
-	sha1C := sha1.Sum(append(newNonce, newNonce...))
-	copy(tmpAesKeyAndIV, sha1A[:])
-	copy(tmpAesKeyAndIV[20:], sha1B[:])
-	copy(tmpAesKeyAndIV[40:], sha1C[:])
-	copy(tmpAesKeyAndIV[60:], newNonce[:4])
-	tmpLen := 20 + len(serverDHInnerDataBuf)
-	if tmpLen%16 > 0 { tmpLen = (tmpLen/16 + 1) * 16 } else { tmpLen = 20 + len(serverDHInnerDataBuf) }
-	tmpEncryptedAnswer := make([]byte, tmpLen)
-	sha1Tmp := sha1.Sum(serverDHInnerDataBuf)
-	copy(tmpEncryptedAnswer, sha1Tmp[:])
-	copy(tmpEncryptedAnswer[20:], serverDHInnerDataBuf)
-	e := crypto.NewAES256IGECryptor(tmpAesKeyAndIV[:32], tmpAesKeyAndIV[32:64])
-	tmpEncryptedAnswer, _ = e.Encrypt(tmpEncryptedAnswer)
-	serverDHParams := mtproto.MakeTLServer_DHParamsOk(&mtproto.Server_DH_Params{Constructor: mtproto.TLConstructor(mtproto.TLConstructor_CRC32_server_DH_params_ok), Nonce: reqDhParam.Nonce, ServerNonce: reqDhParam.ServerNonce, EncryptedAnswer: hack.String(tmpEncryptedAnswer)}).To_Server_DH_Params()
-	_ = handshakeType
-	_ = expiresIn
-	cp.sendHandshakeRes(serverDHParams)
-	return reqDhParam.Nonce, reqDhParam.ServerNonce, newNonce, A, nil
-}
-
-func handleSetClientDHParams(cp *ConnProp, obj mtproto.TLObject, nonce, serverNonce, newNonce, A []byte) error {
-	setClientDHParams, _ := obj.(*mtproto.TLSetClient_DHParams)
-	if !bytes.Equal(setClientDHParams.Nonce, nonce) { return fmt.Errorf("onSetClientDHParams - Wrong Nonce") }
-	if !bytes.Equal(setClientDHParams.ServerNonce, serverNonce) { return fmt.Errorf("onSetClientDHParams - Wrong ServerNonce")}
-	bEncryptedData := []byte(setClientDHParams.EncryptedData)
-	tmpAesKeyAndIv := make([]byte, 64)
-	sha1A := sha1.Sum(append(newNonce, serverNonce...))
-	sha1B := sha1.Sum(append(serverNonce, newNonce...))
-	sha1C := sha1.Sum(append(newNonce, newNonce...))
-	copy(tmpAesKeyAndIv, sha1A[:])
-	copy(tmpAesKeyAndIv[20:], sha1B[:])
-	copy(tmpAesKeyAndIv[40:], sha1C[:])
-	copy(tmpAesKeyAndIv[60:], newNonce[:4])
-	d := crypto.NewAES256IGECryptor(tmpAesKeyAndIv[:32], tmpAesKeyAndIv[32:64])
-	decryptedData, err := d.Decrypt(bEncryptedData)
-	if err != nil { return fmt.Errorf("onSetClientDHParams - AES256IGECryptor decrypt error")}
-	dBuf := mtproto.NewDecodeBuf(decryptedData[20:])
-	clientDHInnerData := mtproto.MakeTLClient_DHInnerData(nil)
-	clientDHInnerData.Data2.Constructor = mtproto.TLConstructor(dBuf.Int())
-	err = clientDHInnerData.Decode(dBuf)
-	if err != nil { log.Printf("onSetClientDHParams - TLClient_DHInnerData decode error: %s", err); return err }
-	if !bytes.Equal(clientDHInnerData.GetNonce(), nonce) { return fmt.Errorf("onSetClientDHParams - Wrong client_DHInnerData's Nonce") }
-	if !bytes.Equal(clientDHInnerData.GetServerNonce(), serverNonce) { return fmt.Errorf("onSetClientDHParams - Wrong client_DHInnerData's ServerNonce") }
-	bigIntA := new(big.Int).SetBytes(A)
-	authKeyNum := new(big.Int)
-	authKeyNum.Exp(new(big.Int).SetBytes([]byte(clientDHInnerData.GetGB())), bigIntA, gBigIntDH2048P)
-	authKey := make([]byte, 256)
-	copy(authKey[256-len(authKeyNum.Bytes()):], authKeyNum.Bytes())
-	authKeyAuxHash := make([]byte, len(newNonce))
-	copy(authKeyAuxHash, newNonce)
-	authKeyAuxHash = append(authKeyAuxHash, byte(0x01))
-	sha1D := sha1.Sum(authKey)
-	authKeyAuxHash = append(authKeyAuxHash, sha1D[:]...)
-	sha1E := sha1.Sum(authKeyAuxHash[:len(authKeyAuxHash)-12])
-	authKeyAuxHash = append(authKeyAuxHash, sha1E[:]...)
-	authKeyId := int64(binary.LittleEndian.Uint64(authKeyAuxHash[len(newNonce)+1+12 : len(newNonce)+1+12+8]))
-
-	// Save auth key to MongoDB
-	cp.authKey = crypto.NewAuthKey(authKeyId, authKey)
-	if err := SaveAuthKey(authKey, authKeyId); err != nil {
-		log.Printf("[Conn %d] Failed to save auth key: %v\n", cp.connID, err)
-	} else {
-		log.Printf("[Conn %d] Auth key created and saved to MongoDB: %d\n", cp.connID, authKeyId)
-	}
-
-	dhGen := mtproto.MakeTLDhGenOk(&mtproto.SetClient_DHParamsAnswer{Nonce: nonce, ServerNonce: serverNonce, NewNonceHash1: calcNewNonceHash(newNonce, authKey, 0x01)}).To_SetClient_DHParamsAnswer()
-	cp.sendHandshakeRes(dhGen)
-	return nil
-}
-
-func handleReqPqMulti(obj mtproto.TLObject) mtproto.TLObject {
-	reqPq, _ := obj.(*mtproto.TLReqPqMulti)
-	var pq = string([]byte{0x17, 0xED, 0x48, 0x94, 0x1A, 0x08, 0xF9, 0x81})
-	resPQ := mtproto.MakeTLResPQ(&mtproto.ResPQ{
-		Nonce: reqPq.Nonce, 
-		ServerNonce: crypto.GenerateNonce(16), 
-		Pq: pq, 
-		ServerPublicKeyFingerprints: []int64{-6205835210776354611},
-	}).To_ResPQ()
-	return resPQ
+	serializeToBuffer(x, mtproto.GenerateMessageId(), obj)
+	cp.writeFrame(x.GetBuf())
 }
 
 func calcNewNonceHash(newNonce, authKey []byte, b byte) []byte {
@@ -245,31 +102,6 @@ func buildLangpackResponse() []byte {
 	return langBuf.GetBuf()
 }
 
-func (cp *ConnProp) handleInvokeQuery(query mtproto.TLObject, msgId int64) *mtproto.EncodeBuf {
-
-	qBuf := mtproto.NewDecodeBuf(query.(*mtproto.TLInitConnection).GetQuery())
-	query = qBuf.Object()
-	logf(1, "In query %T\n", query)
-	return cp.overlapWithInvokeRes(query, msgId)
-}
-
-func (cp *ConnProp) overlapWithInvokeRes(query mtproto.TLObject, msgId int64) *mtproto.EncodeBuf {
-	buf := mtproto.NewEncodeBuf(1024); buf.Int(-212046591); buf.Long(msgId)
-
-	switch query.(type) {
-	case *mtproto.TLLangpackGetLanguages:
-		buf.Bytes(buildLangpackResponse())
-	case *mtproto.TLHelpGetNearestDc:
-		buf.Int(-1910892683); buf.String("CN"); buf.Int(1); buf.Int(1)
-	case *mtproto.TLHelpGetCountriesList:
-		help_countriesList.Encode(buf, 158)
-	default:
-		buf.Int(481674261); buf.Int(0) // empty vector
-	}
-
-	return buf
-}
-
 func (cp *ConnProp) encodeAndSend(obj mtproto.TLObject, msgId, salt, sessionId int64, bufSize int) {
 	initialSize := 512
 	if bufSize > 0 && bufSize < 2048 {
@@ -278,53 +110,82 @@ func (cp *ConnProp) encodeAndSend(obj mtproto.TLObject, msgId, salt, sessionId i
 	buf := mtproto.NewEncodeBuf(initialSize)
 	buf.Int(-212046591) // rpc_result
 	buf.Long(msgId)
-	obj.Encode(buf, 158)
+	obj.Encode(buf, cp.encodeLayer())
 	cp.send(buf.GetBuf(), salt, sessionId)
 }
 
 func (cp *ConnProp) replyMsg(o mtproto.TLObject, msgId, salt, sessionId int64) {
 	switch obj := o.(type) {
+	case *mtproto.TLPing:
+		buf := mtproto.NewEncodeBuf(88)
+		buf.Int(0x347773c5); buf.Long(msgId); buf.Long(obj.PingId)
+		cp.send(buf.GetBuf(), salt, sessionId)
 	case *mtproto.TLPingDelayDisconnect:
 		buf := mtproto.NewEncodeBuf(88)
 		buf.Int(0x347773c5); buf.Long(msgId); buf.Long(obj.PingId)
 		cp.send(buf.GetBuf(), salt, sessionId)
+	case *mtproto.TLMsgsAck:
+		getSessionState(cp.authKey.AuthKeyId(), sessionId).ack(obj.GetMsgIds())
+	case *mtproto.TLMsgsStateReq:
+		cp.HandleMsgsStateReq(obj, msgId, salt, sessionId)
+	case *mtproto.TLMsgResendReq:
+		cp.HandleMsgResendReq(obj, msgId, salt, sessionId)
+	case *mtproto.TLMsgsAllInfo:
+		cp.HandleMsgsAllInfo(obj, msgId, salt, sessionId)
+	case *mtproto.TLGetFutureSalts:
+		cp.HandleGetFutureSalts(obj, msgId, salt, sessionId)
 	case *mtproto.TLDestroySession:
-		destroyData := mtproto.NewEncodeBuf(8); destroyData.Long(obj.SessionId)
-		buf := mtproto.NewEncodeBuf(32)
-		buf.Int(-212046591); buf.Long(msgId); buf.Int(-501201412); buf.Bytes(destroyData.GetBuf())
-		cp.send(buf.GetBuf(), salt, sessionId)
-	case *mtproto.TLInvokeWithLayer:
-		invLayer := o.(*mtproto.TLInvokeWithLayer)
-		newSessionData := mtproto.NewEncodeBuf(512)
-		newSessionData.Int(-1631450872); newSessionData.Long(msgId); newSessionData.Long(time.Now().UnixNano()); newSessionData.Long(salt)
-		cp.send(newSessionData.GetBuf(), salt, sessionId)
-		dBuf := mtproto.NewDecodeBuf(invLayer.Query)
-		query := dBuf.Object()
-		buf := cp.handleInvokeQuery(query, msgId)
-		cp.send(buf.GetBuf(), salt, sessionId)
+		cp.HandleDestroySession(obj, msgId, salt, sessionId)
+	case *mtproto.TLDestroyAuthKey:
+		cp.HandleDestroyAuthKey(obj, msgId, salt, sessionId)
 	case *mtproto.TLAuthSendCode:
 		cp.HandleAuthSendCode(obj, msgId, salt, sessionId)
+	case *mtproto.TLAuthResendCode:
+		cp.HandleAuthResendCode(obj, msgId, salt, sessionId)
+	case *mtproto.TLAuthCancelCode:
+		cp.HandleAuthCancelCode(obj, msgId, salt, sessionId)
 	case *mtproto.TLAuthSignIn:
 		cp.HandleAuthSignIn(obj, msgId, salt, sessionId)
 	case *mtproto.TLAuthSignUp:
 		cp.HandleAuthSignUp(obj, msgId, salt, sessionId)
+	case *mtproto.TLAuthCheckPassword:
+		cp.HandleAuthCheckPassword(obj, msgId, salt, sessionId)
+	case *mtproto.TLAuthExportLoginToken:
+		cp.HandleAuthExportLoginToken(obj, msgId, salt, sessionId)
+	case *mtproto.TLAuthImportLoginToken:
+		cp.HandleAuthImportLoginToken(obj, msgId, salt, sessionId)
+	case *mtproto.TLAuthAcceptLoginToken:
+		cp.HandleAuthAcceptLoginToken(obj, msgId, salt, sessionId)
+	case *mtproto.TLAuthLogOut:
+		cp.HandleAuthLogOut(obj, msgId, salt, sessionId)
+	case *mtproto.TLAuthResetAuthorizations:
+		cp.HandleAuthResetAuthorizations(obj, msgId, salt, sessionId)
+	case *mtproto.TLAuthBindTempAuthKey:
+		cp.HandleAuthBindTempAuthKey(obj, msgId, salt, sessionId)
+	case *mtproto.TLAccountGetAuthorizations:
+		cp.HandleAccountGetAuthorizations(obj, msgId, salt, sessionId)
+	case *mtproto.TLAccountResetAuthorization:
+		cp.HandleAccountResetAuthorization(obj, msgId, salt, sessionId)
+	case *mtproto.TLAccountGetPassword:
+		cp.HandleAccountGetPassword(obj, msgId, salt, sessionId)
+	case *mtproto.TLAccountGetPasswordSettings:
+		cp.HandleAccountGetPasswordSettings(obj, msgId, salt, sessionId)
+	case *mtproto.TLAccountUpdatePasswordSettings:
+		cp.HandleAccountUpdatePasswordSettings(obj, msgId, salt, sessionId)
 	case *mtproto.TLLangpackGetLanguages:
-		// Standalone langpack request (not in invoke) - use gzip compression
+		// send gzips the langpack list
 		langData := buildLangpackResponse()
-		compressed, err := gzipCompress(langData)
-		buf := mtproto.NewEncodeBuf(len(compressed) + 64)
+		buf := mtproto.NewEncodeBuf(len(langData) + 16)
 		buf.Int(-212046591); buf.Long(msgId)
-		if err != nil {
-			logf(1, "Failed to gzip compress langpack response: %v\n", err)
-			buf.Bytes(langData)
-		} else {
-			buf.Int(0x3072cfa1) // gzip_packed
-			buf.String(string(compressed)) // Use String() for proper TL encoding
-		}
+		buf.Bytes(langData)
 		cp.send(buf.GetBuf(), salt, sessionId)
-	case *mtproto.TLHelpGetNearestDc, *mtproto.TLHelpGetCountriesList:
-		buf := cp.overlapWithInvokeRes(obj, msgId)
+	case *mtproto.TLHelpGetNearestDc:
+		buf := mtproto.NewEncodeBuf(64)
+		buf.Int(-212046591); buf.Long(msgId)
+		buf.Int(-1910892683); buf.String("CN"); buf.Int(1); buf.Int(1) // nearestDc
 		cp.send(buf.GetBuf(), salt, sessionId)
+	case *mtproto.TLHelpGetCountriesList:
+		cp.encodeAndSend(help_countriesList, msgId, salt, sessionId, 1024)
 	case *mtproto.TLMessagesGetStickers:
 		cp.encodeAndSend(messages_stickers, msgId, salt, sessionId, 1024)
 	case *mtproto.TLHelpGetPromoData:
@@ -535,8 +396,8 @@ func (cp *ConnProp) replyMsg(o mtproto.TLObject, msgId, salt, sessionId int64) {
 			}
 		}
 
-		// If nothing matches, return a not found error or empty response
 		logf(1, "Sticker set not found: %+v\n", stickerSet)
+		cp.sendRpcError(mtproto.ErrStickersetInvalid, msgId, salt, sessionId)
 	case *mtproto.TLMessagesGetFeaturedStickers, *mtproto.TLMessagesGetFeaturedEmojiStickers:
 		cp.encodeAndSend(featured_stickers, msgId, salt, sessionId, 30000)
 	case *mtproto.TLMessagesGetDialogFiltersF19ED96D:
@@ -581,7 +442,7 @@ func (cp *ConnProp) replyMsg(o mtproto.TLObject, msgId, salt, sessionId int64) {
 				buf := mtproto.NewEncodeBuf(512)
 				buf.Int(-212046591)
 				buf.Long(msgId)
-				result.Encode(buf, 158)
+				result.Encode(buf, cp.encodeLayer())
 				cp.send(buf.GetBuf(), salt, sessionId)
 				return
 			}
@@ -638,15 +499,34 @@ func (cp *ConnProp) replyMsg(o mtproto.TLObject, msgId, salt, sessionId int64) {
 			buf := mtproto.NewEncodeBuf(len(chunk)+512)
 			buf.Int(-212046591) // rpc_result constructor
 			buf.Long(msgId)     // original request msg_id
-			result.Encode(buf, 158)
+			result.Encode(buf, cp.encodeLayer())
 			cp.send(buf.GetBuf(), salt, sessionId)
+		} else {
+			logf(1, "[Conn %d] upload.getFile: unsupported location %v\n", cp.connID, location)
+			cp.sendRpcError(mtproto.ErrLocationInvalid, msgId, salt, sessionId)
 		}
 	case *mtproto.TLMsgContainer:
+		// Inner messages are validated like top-level ones, except that a
+		// duplicate is only skipped: the client may resend a message in a
+		// new container before it sees the ack.
+		state := getSessionState(cp.authKey.AuthKeyId(), sessionId)
 		for _, m := range obj.Messages {
 			logf(1, "In container %T\n", m.Object)
-			cp.replyMsg(m.Object, m.MsgId, salt, sessionId)
+			if state.replayed(m.MsgId) {
+				logf(1, "[Conn %d] Skipping duplicate msg %d in container\n", cp.connID, m.MsgId)
+				continue
+			}
+			if !cp.checkServiceLayer(m.MsgId, m.Seqno, salt, sessionId) {
+				continue
+			}
+			if m.Seqno&1 == 1 {
+				cp.queueAck(m.MsgId)
+			}
+			cp.dispatch(m.Object, m.MsgId, salt, sessionId)
 		}
 	default:
+		// Answer anyway so the client does not wait for a timeout
 		logf(1, "Not found %T\n", obj)
+		cp.sendRpcError(mtproto.ErrMethodNotImpl, msgId, salt, sessionId)
 	}
 }
\ No newline at end of file
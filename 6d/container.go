@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+const (
+	gzipPackedThreshold = 1024       // rpc_result bodies above this are sent as gzip_packed
+	containerMaxBytes   = 256 * 1024 // Messages are batched into containers up to this size
+	containerMaxCount   = 1020       // Protocol limit of messages per container
+)
+
+// queuedMessage is a server message waiting for the end of the current batch.
+type queuedMessage struct {
+	msgId     int64
+	seqNo     int32
+	body      []byte
+	salt      int64
+	sessionId int64
+}
+
+// beginBatch starts collecting outgoing messages instead of writing them, so
+// everything produced while handling one incoming packet leaves in a single
+// msg_container.
+func (cp *ConnProp) beginBatch() {
+	cp.outMu.Lock()
+	cp.batching = true
+	cp.outMu.Unlock()
+}
+
+// enqueue writes a server message, or queues it if a batch is open.
+func (cp *ConnProp) enqueue(msgId int64, seqNo int32, body []byte, salt, sessionId int64) {
+	cp.outMu.Lock()
+	if cp.batching {
+		cp.outQueue = append(cp.outQueue, queuedMessage{msgId, seqNo, body, salt, sessionId})
+		cp.outMu.Unlock()
+		return
+	}
+	cp.outMu.Unlock()
+	cp.sendMessage(msgId, seqNo, body, salt, sessionId)
+}
+
+// queueAck schedules a msgs_ack for a content-related client message. Acks
+// are only sent with the next flush.
+func (cp *ConnProp) queueAck(msgId int64) {
+	cp.outMu.Lock()
+	cp.pendingAcks = append(cp.pendingAcks, msgId)
+	cp.outMu.Unlock()
+}
+
+// flush closes the batch and writes the queued messages together with the
+// pending acks, packing several messages of a session into msg_containers.
+func (cp *ConnProp) flush() {
+	cp.mu.Lock()
+	salt, sessionId := cp.salt, cp.sessionID
+	cp.mu.Unlock()
+
+	cp.outMu.Lock()
+	queue, acks := cp.outQueue, cp.pendingAcks
+	cp.outQueue, cp.pendingAcks, cp.batching = nil, nil, false
+	cp.outMu.Unlock()
+
+	if cp.authKey == nil || len(queue) == 0 && len(acks) == 0 {
+		return
+	}
+
+	state := getSessionState(cp.authKey.AuthKeyId(), sessionId)
+	if len(acks) > 0 {
+		ack := mtproto.NewEncodeBuf(16 + 8*len(acks))
+		ack.Int(0x62d6b459) // msgs_ack
+		ack.Int(481674261)  // vector
+		ack.Int(int32(len(acks)))
+		for _, id := range acks {
+			ack.Long(id)
+		}
+		msgId, seqNo := state.nextOutgoing(ack.GetBuf())
+		queue = append(queue, queuedMessage{msgId, seqNo, ack.GetBuf(), salt, sessionId})
+	}
+
+	for len(queue) > 0 {
+		// Take the longest run of messages of one session that fits a container
+		n, size := 1, 16+len(queue[0].body)
+		for n < len(queue) && n < containerMaxCount && queue[n].sessionId == queue[0].sessionId {
+			size += 16 + len(queue[n].body)
+			if size > containerMaxBytes {
+				break
+			}
+			n++
+		}
+		batch := queue[:n]
+		queue = queue[n:]
+
+		first := batch[0]
+		if len(batch) == 1 {
+			cp.sendMessage(first.msgId, first.seqNo, first.body, first.salt, first.sessionId)
+			continue
+		}
+
+		container := mtproto.NewEncodeBuf(size + 8)
+		container.Int(0x73f1f8dc) // msg_container
+		container.Int(int32(len(batch)))
+		for _, m := range batch {
+			container.Long(m.msgId)
+			container.Int(m.seqNo)
+			container.Int(int32(len(m.body)))
+			container.Bytes(m.body)
+		}
+		// The container gets a msg_id above all of its messages and is not
+		// content-related itself
+		msgId, seqNo := getSessionState(cp.authKey.AuthKeyId(), first.sessionId).nextOutgoing(nil)
+		logf(2, "[Conn %d] Sending container %d with %d messages (%d bytes)\n", cp.connID, msgId, len(batch), size)
+		cp.sendMessage(msgId, seqNo, container.GetBuf(), first.salt, first.sessionId)
+	}
+}
+
+// packRpcResult replaces the result of a large rpc_result body with
+// gzip_packed if that makes it smaller. Other bodies are returned as is.
+func packRpcResult(body []byte) []byte {
+	if len(body) <= gzipPackedThreshold || int32(binary.LittleEndian.Uint32(body)) != -212046591 {
+		return body
+	}
+	// Results that already are gzip_packed stay untouched
+	if binary.LittleEndian.Uint32(body[12:]) == 0x3072cfa1 {
+		return body
+	}
+
+	compressed, err := gzipCompress(body[12:])
+	if err != nil {
+		logf(1, "Failed to gzip rpc_result: %v\n", err)
+		return body
+	}
+	packed := mtproto.NewEncodeBuf(len(compressed) + 24)
+	packed.Bytes(body[:12]) // rpc_result constructor and req_msg_id
+	packed.Int(0x3072cfa1)  // gzip_packed
+	packed.String(string(compressed))
+	if len(packed.GetBuf()) >= len(body) {
+		return body
+	}
+	return packed.GetBuf()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+// rpcResultBody builds an rpc_result for reqMsgId around result.
+func rpcResultBody(reqMsgId int64, result []byte) []byte {
+	body := make([]byte, 12, 12+len(result))
+	binary.LittleEndian.PutUint32(body, 0xf35c6d01)
+	binary.LittleEndian.PutUint64(body[4:], uint64(reqMsgId))
+	return append(body, result...)
+}
+
+func TestPackRpcResult(t *testing.T) {
+	compressible := rpcResultBody(42, bytes.Repeat([]byte("abcd"), gzipPackedThreshold))
+	random := make([]byte, 4*gzipPackedThreshold)
+	rand.Read(random)
+	alreadyPacked := rpcResultBody(42, append([]byte{0xa1, 0xcf, 0x72, 0x30}, bytes.Repeat([]byte{0}, 2*gzipPackedThreshold)...))
+	notRpcResult := bytes.Repeat([]byte{0}, 2*gzipPackedThreshold)
+
+	tests := []struct {
+		name       string
+		body       []byte
+		wantPacked bool
+	}{
+		{"small result", rpcResultBody(42, bytes.Repeat([]byte{0}, 64)), false},
+		{"large compressible result", compressible, true},
+		{"large random result", rpcResultBody(42, random), false},
+		{"already gzip_packed", alreadyPacked, false},
+		{"not an rpc_result", notRpcResult, false},
+	}
+	for _, tt := range tests {
+		got := packRpcResult(tt.body)
+		if !tt.wantPacked {
+			if !bytes.Equal(got, tt.body) {
+				t.Errorf("%s: body was changed", tt.name)
+			}
+			continue
+		}
+
+		if len(got) >= len(tt.body) {
+			t.Errorf("%s: packed body of %d bytes is not smaller than %d", tt.name, len(got), len(tt.body))
+		}
+		if !bytes.Equal(got[:12], tt.body[:12]) {
+			t.Errorf("%s: rpc_result header changed", tt.name)
+		}
+		if binary.LittleEndian.Uint32(got[12:]) != 0x3072cfa1 {
+			t.Errorf("%s: result is not gzip_packed", tt.name)
+			continue
+		}
+		r, err := gzip.NewReader(bytes.NewReader(mtproto.NewDecodeBuf(got[16:]).StringBytes()))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		unpacked, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(unpacked, tt.body[12:]) {
+			t.Errorf("%s: gzip_packed does not hold the original result (err %v)", tt.name, err)
+		}
+	}
+}
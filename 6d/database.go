@@ -2,27 +2,27 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"time"
 
-	"github.com/teamgram/proto/mtproto/crypto"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
-	mongoClient          *mongo.Client
-	authKeysCollection   *mongo.Collection
-	usersCollection      *mongo.Collection
-	sessionsCollection   *mongo.Collection
-	phoneCodesCollection *mongo.Collection
-	fileDataCollection   *mongo.Collection
-	contactsCollection   *mongo.Collection
-	messagesCollection   *mongo.Collection
-	dialogsCollection    *mongo.Collection
+	mongoClient           *mongo.Client
+	authKeysCollection    *mongo.Collection
+	usersCollection       *mongo.Collection
+	sessionsCollection    *mongo.Collection
+	phoneCodesCollection  *mongo.Collection
+	fileDataCollection    *mongo.Collection
+	contactsCollection    *mongo.Collection
+	messagesCollection    *mongo.Collection
+	dialogsCollection     *mongo.Collection
+	updateLogCollection   *mongo.Collection
+	serverSaltsCollection *mongo.Collection
 )
 
 // AuthKeyDoc represents the MongoDB document for auth keys
@@ -32,6 +32,12 @@ type AuthKeyDoc struct {
 	CreatedAt  time.Time `bson:"created_at"`
 	UpdatedAt  time.Time `bson:"updated_at"`
 	LastUsedAt time.Time `bson:"last_used_at"`
+
+	// Temporary (PFS) keys only
+	Temp          bool      `bson:"temp,omitempty"`
+	Media         bool      `bson:"media,omitempty"`            // Created for media connections only
+	ExpiresAt     time.Time `bson:"expires_at,omitempty"`       // Key is unusable and purged after this
+	PermAuthKeyID int64     `bson:"perm_auth_key_id,omitempty"` // Set by auth.bindTempAuthKey
 }
 
 // UserDoc stores user data following MTProto User type field names
@@ -62,20 +68,61 @@ type UserDoc struct {
 	Seq int32 `bson:"seq"` // Sequence number (for groups, channels)
 	Date int32 `bson:"date"` // Unix timestamp of last update
 
+	// Two-step verification, nil without a cloud password
+	Password *PasswordDoc `bson:"password,omitempty"`
+
 	CreatedAt  time.Time `bson:"created_at"`
 	UpdatedAt  time.Time `bson:"updated_at"`
 	LastSeenAt time.Time `bson:"last_seen_at"`
 }
 
+// PasswordDoc is a user's cloud password. Only the SRP verifier is kept,
+// never the password or anything it can be recovered from cheaply.
+type PasswordDoc struct {
+	Salt1     []byte    `bson:"salt1"`    // passwordKdfAlgoModPow salt1, including the client's part
+	Salt2     []byte    `bson:"salt2"`    // passwordKdfAlgoModPow salt2
+	Verifier  []byte    `bson:"verifier"` // SRP v = g^x mod p
+	Hint      string    `bson:"hint"`
+	Email     string    `bson:"email"` // Recovery email
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
 // SessionDoc links auth_key_id to user sessions
 type SessionDoc struct {
-	SessionID  int64     `bson:"session_id"`  // Session ID from client messages
+	SessionID  int64     `bson:"session_id,omitempty"` // Latest session ID from client messages, unset once destroyed
 	AuthKeyID  int64     `bson:"auth_key_id"` // Auth key used for this session
 	UserID     int64     `bson:"user_id"`     // User ID (0 if not authenticated yet)
+	AuthHash   int64     `bson:"auth_hash,omitempty"` // Random id of the session in account.authorizations
 	Salt       int64     `bson:"salt"`        // Current salt
 	CreatedAt  time.Time `bson:"created_at"`
 	UpdatedAt  time.Time `bson:"updated_at"`
 	LastUsedAt time.Time `bson:"last_used_at"`
+
+	// Client metadata from initConnection/invokeWithLayer
+	ApiID          int32  `bson:"api_id,omitempty"`
+	DeviceModel    string `bson:"device_model,omitempty"`
+	SystemVersion  string `bson:"system_version,omitempty"`
+	AppVersion     string `bson:"app_version,omitempty"`
+	SystemLangCode string `bson:"system_lang_code,omitempty"`
+	LangPack       string `bson:"lang_pack,omitempty"`
+	LangCode       string `bson:"lang_code,omitempty"`
+	Layer          int32  `bson:"layer,omitempty"`
+	ClientIP       string `bson:"client_ip,omitempty"`
+}
+
+// ServerSaltsDoc holds the salts issued to an auth key. They live apart from
+// SessionDoc so keys that never log in don't need a session.
+type ServerSaltsDoc struct {
+	AuthKeyID int64           `bson:"auth_key_id"`
+	Salts     []ServerSaltDoc `bson:"salts"` // Oldest first
+	UpdatedAt time.Time       `bson:"updated_at"`
+}
+
+// ServerSaltDoc is one server salt with its validity window
+type ServerSaltDoc struct {
+	Salt       int64     `bson:"salt"`
+	ValidSince time.Time `bson:"valid_since"`
+	ValidUntil time.Time `bson:"valid_until"`
 }
 
 // PhoneCodeDoc stores temporary phone verification codes (for auth.sendCode flow)
@@ -84,8 +131,11 @@ type PhoneCodeDoc struct {
 	PhoneCodeHash string    `bson:"phone_code_hash"`  // Hash (matches auth.SentCode.PhoneCodeHash)
 	AuthKeyID     int64     `bson:"auth_key_id"`      // Auth key that requested this code
 	Code          string    `bson:"code"`             // Actual verification code
+	CodeType      string    `bson:"code_type"`        // How the code was last delivered (auth.SentCodeType predicate)
+	SentAt        time.Time `bson:"sent_at"`          // When the code was last delivered
+	Attempts      int       `bson:"attempts"`         // Wrong codes entered so far
 	CreatedAt     time.Time `bson:"created_at"`
-	ExpiresAt     time.Time `bson:"expires_at"`
+	ExpiresAt     time.Time `bson:"expires_at"`       // Removed by the TTL index after this
 	Verified      bool      `bson:"verified"`
 }
 
@@ -163,6 +213,8 @@ func InitMongoDB(mongoURL string) error {
 	contactsCollection = db.Collection("contacts")
 	messagesCollection = db.Collection("messages")
 	dialogsCollection = db.Collection("dialogs")
+	updateLogCollection = db.Collection("update_log")
+	serverSaltsCollection = db.Collection("server_salts")
 
 	// Create indexes for auth_keys
 	authKeyIndexes := []mongo.IndexModel{
@@ -170,6 +222,10 @@ func InitMongoDB(mongoURL string) error {
 			Keys:    bson.D{{Key: "auth_key_id", Value: 1}},
 			Options: options.Index().SetUnique(true),
 		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
 	}
 	_, err = authKeysCollection.Indexes().CreateMany(ctx, authKeyIndexes)
 	if err != nil {
@@ -205,15 +261,26 @@ func InitMongoDB(mongoURL string) error {
 		log.Printf("Warning: Could not create users indexes: %v", err)
 	}
 
-	// Create indexes for sessions
+	// Create indexes for sessions. session_id is only unique among the
+	// sessions that have one: keys without a live session leave it unset, and
+	// a plain unique index would allow just one of those. Replaces the
+	// non-partial session_id_1 index of earlier versions.
+	if _, err := sessionsCollection.Indexes().DropOne(ctx, "session_id_1"); err == nil {
+		log.Printf("Dropped non-partial sessions index session_id_1")
+	}
+	if _, err := sessionsCollection.Indexes().DropOne(ctx, "auth_key_id_1"); err == nil {
+		log.Printf("Dropped non-unique sessions index auth_key_id_1")
+	}
 	sessionIndexes := []mongo.IndexModel{
 		{
-			Keys:    bson.D{{Key: "session_id", Value: 1}},
-			Options: options.Index().SetUnique(true),
+			Keys: bson.D{{Key: "session_id", Value: 1}},
+			Options: options.Index().SetName("session_id_partial").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"session_id": bson.M{"$exists": true}}),
 		},
 		{
+			// One session document per auth key, see upsertSession
 			Keys:    bson.D{{Key: "auth_key_id", Value: 1}},
-			Options: options.Index(),
+			Options: options.Index().SetName("auth_key_id_unique").SetUnique(true),
 		},
 		{
 			Keys:    bson.D{{Key: "user_id", Value: 1}},
@@ -317,26 +384,43 @@ func InitMongoDB(mongoURL string) error {
 		log.Printf("Warning: Could not create dialogs indexes: %v", err)
 	}
 
+	// Create indexes for update_log
+	updateLogIndexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "pts", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	}
+	_, err = updateLogCollection.Indexes().CreateMany(ctx, updateLogIndexes)
+	if err != nil {
+		log.Printf("Warning: Could not create update_log indexes: %v", err)
+	}
+
+	// Create indexes for server_salts
+	_, err = serverSaltsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "auth_key_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Warning: Could not create server_salts indexes: %v", err)
+	}
+
 	log.Printf("Connected to MongoDB successfully")
 	return nil
 }
 
 // SaveAuthKey saves an auth key to MongoDB
-func SaveAuthKey(authKey []byte, authKeyID int64) error {
+func SaveAuthKey(doc *AuthKeyDoc) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	now := time.Now()
-	doc := AuthKeyDoc{
-		AuthKeyID:  authKeyID,
-		AuthKey:    authKey,
-		CreatedAt:  now,
-		UpdatedAt:  now,
-		LastUsedAt: now,
-	}
+	doc.CreatedAt = now
+	doc.UpdatedAt = now
+	doc.LastUsedAt = now
 
 	opts := options.Update().SetUpsert(true)
-	filter := bson.M{"auth_key_id": authKeyID}
+	filter := bson.M{"auth_key_id": doc.AuthKeyID}
 	update := bson.M{"$set": doc}
 
 	_, err := authKeysCollection.UpdateOne(ctx, filter, update, opts)
@@ -344,12 +428,12 @@ func SaveAuthKey(authKey []byte, authKeyID int64) error {
 		return fmt.Errorf("failed to save auth key: %w", err)
 	}
 
-	log.Printf("Auth key saved to MongoDB: %d", authKeyID)
+	log.Printf("Auth key saved to MongoDB: %d (temp: %v)", doc.AuthKeyID, doc.Temp)
 	return nil
 }
 
-// LoadAuthKeyByID loads an auth key from MongoDB by auth key ID
-func LoadAuthKeyByID(authKeyID int64) (*crypto.AuthKey, error) {
+// LoadAuthKeyByID loads an auth key document from MongoDB by auth key ID
+func LoadAuthKeyByID(authKeyID int64) (*AuthKeyDoc, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -371,35 +455,81 @@ func LoadAuthKeyByID(authKeyID int64) (*crypto.AuthKey, error) {
 		authKeysCollection.UpdateOne(ctx, filter, update)
 	}()
 
-	authKey := crypto.NewAuthKey(doc.AuthKeyID, doc.AuthKey)
-	return authKey, nil
+	return &doc, nil
 }
 
+// BindTempAuthKey binds a temporary auth key to a permanent one until expiresAt
+func BindTempAuthKey(tempAuthKeyID, permAuthKeyID int64, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-// FindAuthKeyByPrefix searches for an auth key ID in the data and loads it
-func FindAuthKeyInData(data []byte) (*crypto.AuthKey, int, error) {
-	if len(data) < 8 {
-		return nil, -1, nil
+	filter := bson.M{"auth_key_id": tempAuthKeyID, "temp": true}
+	update := bson.M{"$set": bson.M{
+		"perm_auth_key_id": permAuthKeyID,
+		"expires_at":       expiresAt,
+		"updated_at":       time.Now(),
+	}}
+	if _, err := authKeysCollection.UpdateOne(ctx, filter, update); err != nil {
+		return fmt.Errorf("failed to bind temp auth key: %w", err)
 	}
+	return nil
+}
 
-	// Search for auth key ID in the data
-	for i := 0; i <= len(data)-8; i++ {
-		authKeyID := int64(binary.LittleEndian.Uint64(data[i:i+8]))
+// DeleteAuthKey deletes an auth key together with its session, which logs
+// its user out. It reports whether the key existed.
+func DeleteAuthKey(authKeyID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-		// Try to load this auth key from MongoDB
-		authKey, err := LoadAuthKeyByID(authKeyID)
-		if err != nil {
-			continue
-		}
-		if authKey != nil {
-			log.Printf("Auth key ID %d found at offset %d", authKeyID, i)
-			return authKey, i, nil
-		}
+	result, err := authKeysCollection.DeleteOne(ctx, bson.M{"auth_key_id": authKeyID})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete auth key: %w", err)
+	}
+	if _, err := sessionsCollection.DeleteMany(ctx, bson.M{"auth_key_id": authKeyID}); err != nil {
+		return true, fmt.Errorf("failed to delete sessions of auth key: %w", err)
+	}
+	if _, err := serverSaltsCollection.DeleteOne(ctx, bson.M{"auth_key_id": authKeyID}); err != nil {
+		return true, fmt.Errorf("failed to delete server salts of auth key: %w", err)
 	}
+	return result.DeletedCount > 0, nil
+}
 
-	return nil, -1, nil
+// PurgeExpiredAuthKeys deletes expired temporary auth keys together with their
+// sessions and returns their ids
+func PurgeExpiredAuthKeys() ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"expires_at": bson.M{"$lte": time.Now()}}
+	cursor, err := authKeysCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"auth_key_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired auth keys: %w", err)
+	}
+	var docs []AuthKeyDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode expired auth keys: %w", err)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.AuthKeyID
+	}
+	if _, err := authKeysCollection.DeleteMany(ctx, bson.M{"auth_key_id": bson.M{"$in": ids}}); err != nil {
+		return nil, fmt.Errorf("failed to delete expired auth keys: %w", err)
+	}
+	if _, err := sessionsCollection.DeleteMany(ctx, bson.M{"auth_key_id": bson.M{"$in": ids}}); err != nil {
+		return ids, fmt.Errorf("failed to delete sessions of expired auth keys: %w", err)
+	}
+	if _, err := serverSaltsCollection.DeleteMany(ctx, bson.M{"auth_key_id": bson.M{"$in": ids}}); err != nil {
+		return ids, fmt.Errorf("failed to delete server salts of expired auth keys: %w", err)
+	}
+	return ids, nil
 }
 
+
 // User management functions
 
 // FindUserByPhone finds a user by phone number
@@ -446,6 +576,7 @@ func CreateUser(user *UserDoc) error {
 	update := bson.M{
 		"$setOnInsert": bson.M{
 			"created_at": user.CreatedAt,
+			"pts":        int32(1), // getState reports 1 for a fresh user, so the journal starts after it
 		},
 		"$set": bson.M{
 			"access_hash":    user.AccessHash,
@@ -503,6 +634,22 @@ func UpdateUser(user *UserDoc) error {
 	return nil
 }
 
+// SetUserPassword replaces the cloud password of a user; nil removes it
+func SetUserPassword(userID int64, password *PasswordDoc) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$unset": bson.M{"password": ""}, "$set": bson.M{"updated_at": time.Now()}}
+	if password != nil {
+		password.UpdatedAt = time.Now()
+		update = bson.M{"$set": bson.M{"password": password, "updated_at": password.UpdatedAt}}
+	}
+	if _, err := usersCollection.UpdateOne(ctx, bson.M{"id": userID}, update); err != nil {
+		return fmt.Errorf("failed to set user password: %w", err)
+	}
+	return nil
+}
+
 // IncrementUserPts atomically increments a user's pts counter and returns the new value
 // ptsCount: how many pts units to increment (usually 1 for single message, 2+ for multiple updates)
 func IncrementUserPts(userID int64, ptsCount int32) (int32, error) {
@@ -559,39 +706,196 @@ func GetUserState(userID int64) (pts, qts, seq, date int32, err error) {
 
 // Session management functions
 
-// CreateSession creates a new session
-func CreateSession(session *SessionDoc) error {
+// FindSessionByAuthKey finds a session by auth key ID
+func FindSessionByAuthKey(authKeyID int64) (*SessionDoc, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	session.CreatedAt = time.Now()
-	session.UpdatedAt = time.Now()
-	session.LastUsedAt = time.Now()
-
-	_, err := sessionsCollection.InsertOne(ctx, session)
+	var session SessionDoc
+	err := sessionsCollection.FindOne(ctx, bson.M{"auth_key_id": authKeyID}).Decode(&session)
 	if err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find session: %w", err)
 	}
-	return nil
+	return &session, nil
 }
 
-// FindSessionByAuthKey finds a session by auth key ID
-func FindSessionByAuthKey(authKeyID int64) (*SessionDoc, error) {
+// LoadServerSalts returns the server salts of an auth key, oldest first
+func LoadServerSalts(authKeyID int64) ([]ServerSaltDoc, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var session SessionDoc
-	err := sessionsCollection.FindOne(ctx, bson.M{"auth_key_id": authKeyID}).Decode(&session)
+	var doc ServerSaltsDoc
+	err := serverSaltsCollection.FindOne(ctx, bson.M{"auth_key_id": authKeyID}).Decode(&doc)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("failed to find session: %w", err)
+		return nil, fmt.Errorf("failed to load server salts: %w", err)
 	}
-	return &session, nil
+	return doc.Salts, nil
+}
+
+// SaveServerSalts replaces the server salts of an auth key
+func SaveServerSalts(authKeyID int64, salts []ServerSaltDoc) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"auth_key_id": authKeyID,
+		"salts":       salts,
+		"updated_at":  time.Now(),
+	}}
+
+	opts := options.Update().SetUpsert(true)
+	if _, err := serverSaltsCollection.UpdateOne(ctx, bson.M{"auth_key_id": authKeyID}, update, opts); err != nil {
+		return fmt.Errorf("failed to save server salts: %w", err)
+	}
+	return nil
+}
+
+// sessionUpsert builds the update that sets fields on the session document of
+// an auth key. A new document also gets created_at and its random auth_hash,
+// documents of older versions get an auth_hash on their next write.
+func sessionUpsert(authKeyID int64, fields bson.M) mongo.Pipeline {
+	now := time.Now()
+	set := bson.M{
+		"auth_key_id": authKeyID,
+		"updated_at":  now,
+		"created_at":  bson.M{"$ifNull": bson.A{"$created_at", now}},
+		"auth_hash":   bson.M{"$ifNull": bson.A{"$auth_hash", GenerateAccessHash()}},
+	}
+	for k, v := range fields {
+		// Values are client data and must not be read as expressions
+		set[k] = bson.M{"$literal": v}
+	}
+	return mongo.Pipeline{{{Key: "$set", Value: set}}}
+}
+
+// upsertSession sets fields on the session document of an auth key, creating
+// it if needed. Every write that may create a session goes through here, so
+// an auth key never ends up with two documents.
+func upsertSession(ctx context.Context, authKeyID int64, fields bson.M) error {
+	filter := bson.M{"auth_key_id": authKeyID}
+	opts := options.Update().SetUpsert(true)
+	_, err := sessionsCollection.UpdateOne(ctx, filter, sessionUpsert(authKeyID, fields), opts)
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent upsert inserted the document first, update it instead
+		_, err = sessionsCollection.UpdateOne(ctx, filter, sessionUpsert(authKeyID, fields), opts)
+	}
+	return err
+}
+
+// SessionAuthHash returns the auth_hash of the session of an auth key,
+// creating the session or its hash if needed
+func SessionAuthHash(authKeyID int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"auth_key_id": authKeyID}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var session SessionDoc
+	err := sessionsCollection.FindOneAndUpdate(ctx, filter, sessionUpsert(authKeyID, nil), opts).Decode(&session)
+	if mongo.IsDuplicateKeyError(err) {
+		err = sessionsCollection.FindOneAndUpdate(ctx, filter, sessionUpsert(authKeyID, nil), opts).Decode(&session)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get session auth hash: %w", err)
+	}
+	return session.AuthHash, nil
+}
+
+// SaveSessionClientInfo stores the initConnection metadata of a client on the
+// session of its auth key
+func SaveSessionClientInfo(session *SessionDoc) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := upsertSession(ctx, session.AuthKeyID, bson.M{
+		"api_id":           session.ApiID,
+		"device_model":     session.DeviceModel,
+		"system_version":   session.SystemVersion,
+		"app_version":      session.AppVersion,
+		"system_lang_code": session.SystemLangCode,
+		"lang_pack":        session.LangPack,
+		"lang_code":        session.LangCode,
+		"layer":            session.Layer,
+		"client_ip":        session.ClientIP,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save client info: %w", err)
+	}
+	return nil
+}
+
+// FindSessionsByUser returns the sessions of every auth key logged in as userID
+func FindSessionsByUser(userID int64) ([]SessionDoc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := sessionsCollection.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sessions: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []SessionDoc
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, fmt.Errorf("failed to decode sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// ClearSessionUser logs the auth key out: its session keeps existing but is
+// no longer bound to a user
+func ClearSessionUser(authKeyID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$unset": bson.M{"user_id": ""},
+		"$set":   bson.M{"updated_at": time.Now()},
+	}
+	if _, err := sessionsCollection.UpdateOne(ctx, bson.M{"auth_key_id": authKeyID}, update); err != nil {
+		return fmt.Errorf("failed to clear session user: %w", err)
+	}
+	return nil
 }
 
-// UpdateSession updates a session
+// ForgetSessionID removes sessionID from the session record of the auth key
+// if it is the one recorded there. It reports whether it was.
+func ForgetSessionID(authKeyID, sessionID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"auth_key_id": authKeyID, "session_id": sessionID}
+	update := bson.M{
+		"$unset": bson.M{"session_id": ""},
+		"$set":   bson.M{"updated_at": time.Now()},
+	}
+	result, err := sessionsCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to forget session id: %w", err)
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// BindSessionUser logs the auth key in as userID
+func BindSessionUser(authKeyID, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := upsertSession(ctx, authKeyID, bson.M{"user_id": userID}); err != nil {
+		return fmt.Errorf("failed to bind session user: %w", err)
+	}
+	return nil
+}
+
+// UpdateSession records the session_id and salt an auth key used last. It
+// never touches user_id: only sign in binds a user (BindSessionUser) and only
+// log out clears it (ClearSessionUser).
 func UpdateSession(session *SessionDoc) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -600,32 +904,14 @@ func UpdateSession(session *SessionDoc) error {
 	session.UpdatedAt = now
 	session.LastUsedAt = now
 
-	// Use auth_key_id as the unique identifier (multiple session_ids can share same auth key)
-	filter := bson.M{"auth_key_id": session.AuthKeyID}
-
-	// On insert, set created_at; on update, keep existing created_at
-	// Build update document - only set user_id if it's non-zero to avoid overwriting
 	setFields := bson.M{
 		"session_id":   session.SessionID, // Update to latest session_id
 		"salt":         session.Salt,
-		"updated_at":   session.UpdatedAt,
 		"last_used_at": session.LastUsedAt,
 	}
 
-	// Only update user_id if it's non-zero (to preserve existing user_id when authenticated)
-	if session.UserID != 0 {
-		setFields["user_id"] = session.UserID
-	}
-
-	update := bson.M{
-		"$set": setFields,
-		"$setOnInsert": bson.M{
-			"auth_key_id": session.AuthKeyID, // Set auth_key_id only on insert
-			"created_at":  now,
-		},
-	}
-
-	_, err := sessionsCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	// auth_key_id identifies the document (multiple session_ids can share same auth key)
+	err := upsertSession(ctx, session.AuthKeyID, setFields)
 	if err != nil {
 		return fmt.Errorf("failed to update session: %w", err)
 	}
@@ -680,6 +966,73 @@ func MarkPhoneCodeVerified(phoneCodeHash string) error {
 	return nil
 }
 
+// RecordPhoneCodeAttempt counts a wrong code entered for a hash and returns
+// the number of wrong codes so far
+func RecordPhoneCodeAttempt(phoneCodeHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var phoneCode PhoneCodeDoc
+	err := phoneCodesCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"phone_code_hash": phoneCodeHash},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&phoneCode)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record phone code attempt: %w", err)
+	}
+	return phoneCode.Attempts, nil
+}
+
+// UpdatePhoneCodeDelivery records how a code was delivered
+func UpdatePhoneCodeDelivery(phoneCodeHash, codeType string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := phoneCodesCollection.UpdateOne(
+		ctx,
+		bson.M{"phone_code_hash": phoneCodeHash},
+		bson.M{"$set": bson.M{"code_type": codeType}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update phone code delivery: %w", err)
+	}
+	return nil
+}
+
+// ClaimPhoneCodeResend switches a code from fromType to toType if it was last
+// sent before sentBefore. It reports false if the code was resent meanwhile
+// or is too recent, so concurrent resends deliver it only once. The expiry is
+// left alone.
+func ClaimPhoneCodeResend(phoneCodeHash, fromType, toType string, sentBefore time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"phone_code_hash": phoneCodeHash,
+		"code_type":       fromType,
+		"sent_at":         bson.M{"$lte": sentBefore},
+	}
+	update := bson.M{"$set": bson.M{"code_type": toType, "sent_at": time.Now()}}
+	result, err := phoneCodesCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim phone code resend: %w", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// DeletePhoneCode invalidates a phone code hash
+func DeletePhoneCode(phoneCodeHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := phoneCodesCollection.DeleteOne(ctx, bson.M{"phone_code_hash": phoneCodeHash}); err != nil {
+		return fmt.Errorf("failed to delete phone code: %w", err)
+	}
+	return nil
+}
+
 // File data management functions
 
 // SaveFileData saves file data to MongoDB
@@ -976,50 +1329,6 @@ func GetDialogByID(userID, peerUserID int64) (*DialogDoc, error) {
 	return &dialog, nil
 }
 
-// GetPendingMessages retrieves messages that haven't been delivered to a user yet
-func GetPendingMessages(userID int64, lastPts int32) ([]MessageDoc, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	// Find messages where:
-	// 1. The user is the recipient (peer_id = userID and out = false from sender's perspective)
-	// 2. The pts is greater than the user's current pts
-	filter := bson.M{
-		"peer_id": userID,
-		"pts":     bson.M{"$gt": lastPts},
-	}
-
-	opts := options.Find().SetSort(bson.D{{Key: "pts", Value: 1}})
-	cursor, err := messagesCollection.Find(ctx, filter, opts)
-	if err != nil {
-		return nil, err
-	}
-	defer cursor.Close(ctx)
-
-	var messages []MessageDoc
-	if err := cursor.All(ctx, &messages); err != nil {
-		return nil, err
-	}
-	return messages, nil
-}
-
-// UpdateUserPts sets a user's pts value (used after delivering updates)
-func UpdateUserPts(userID int64, newPts int32) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	filter := bson.M{"id": userID}
-	update := bson.M{
-		"$set": bson.M{
-			"pts":        newPts,
-			"updated_at": time.Now(),
-		},
-	}
-
-	_, err := usersCollection.UpdateOne(ctx, filter, update)
-	return err
-}
-
 // UpdateUserLastSeen updates a user's last seen timestamp
 func UpdateUserLastSeen(userID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
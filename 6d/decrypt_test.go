@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+func testAuthKey() *crypto.AuthKey {
+	key := make([]byte, 256)
+	for i := range key {
+		key[i] = byte(i * 7)
+	}
+	return crypto.NewAuthKey(1, key)
+}
+
+// testPlaintext builds a client message with body and padding bytes of
+// padding, claiming a message_data_length of length.
+func testPlaintext(sessionId int64, body []byte, length uint32, padding int) []byte {
+	p := make([]byte, 32, 32+len(body)+padding)
+	binary.LittleEndian.PutUint64(p[0:8], 0x1122334455667788)
+	binary.LittleEndian.PutUint64(p[8:16], uint64(sessionId))
+	binary.LittleEndian.PutUint64(p[16:24], uint64(clientMsgId(time.Now(), 0)))
+	binary.LittleEndian.PutUint32(p[24:28], 1)
+	binary.LittleEndian.PutUint32(p[28:32], length)
+	p = append(p, body...)
+	return append(p, make([]byte, padding)...)
+}
+
+// encryptTestMessage frames plaintext the way a client does.
+func encryptTestMessage(t *testing.T, authKey *crypto.AuthKey, plaintext []byte) []byte {
+	msgKey := messageKey(authKey.AuthKey(), plaintext, clientKeyPart)
+	aesKey, aesIV := messageAesKeyIv(authKey.AuthKey(), msgKey, clientKeyPart)
+	encrypted, err := crypto.NewAES256IGECryptor(aesKey, aesIV).Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	frame := make([]byte, 8, 24+len(encrypted))
+	binary.LittleEndian.PutUint64(frame, uint64(authKey.AuthKeyId()))
+	frame = append(frame, msgKey...)
+	return append(frame, encrypted...)
+}
+
+func TestDecryptMessage(t *testing.T) {
+	authKey := testAuthKey()
+	body := bytes.Repeat([]byte{0xab}, 16)
+
+	tests := []struct {
+		name    string
+		frame   func() []byte
+		wantErr bool
+	}{
+		{"valid", func() []byte {
+			return encryptTestMessage(t, authKey, testPlaintext(42, body, 16, 16))
+		}, false},
+		{"maximum padding", func() []byte {
+			return encryptTestMessage(t, authKey, testPlaintext(42, body, 16, 1024))
+		}, false},
+		{"too short", func() []byte {
+			return make([]byte, 20)
+		}, true},
+		{"not a block multiple", func() []byte {
+			return encryptTestMessage(t, authKey, testPlaintext(42, body, 16, 16))[:24+56]
+		}, true},
+		{"msg_key mismatch", func() []byte {
+			frame := encryptTestMessage(t, authKey, testPlaintext(42, body, 16, 16))
+			frame[8] ^= 1
+			return frame
+		}, true},
+		{"corrupted data", func() []byte {
+			frame := encryptTestMessage(t, authKey, testPlaintext(42, body, 16, 16))
+			frame[len(frame)-1] ^= 1
+			return frame
+		}, true},
+		{"padding too short", func() []byte {
+			return encryptTestMessage(t, authKey, testPlaintext(42, body, 24, 16))
+		}, true},
+		{"padding too long", func() []byte {
+			return encryptTestMessage(t, authKey, testPlaintext(42, body, 16, 1040))
+		}, true},
+		{"length not a multiple of 4", func() []byte {
+			return encryptTestMessage(t, authKey, testPlaintext(42, body, 15, 16))
+		}, true},
+		{"length beyond the data", func() []byte {
+			return encryptTestMessage(t, authKey, testPlaintext(42, body, 64, 16))
+		}, true},
+		{"session_id 0", func() []byte {
+			return encryptTestMessage(t, authKey, testPlaintext(0, body, 16, 16))
+		}, true},
+	}
+	for _, tt := range tests {
+		plaintext, err := decryptMessage(authKey, tt.frame())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: decryptMessage error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !bytes.Equal(plaintext[32:48], body) {
+			t.Errorf("%s: decrypted body %x, want %x", tt.name, plaintext[32:48], body)
+		}
+	}
+}
+
+func TestDecryptMessageWrongKey(t *testing.T) {
+	frame := encryptTestMessage(t, testAuthKey(), testPlaintext(42, make([]byte, 16), 16, 16))
+	other := crypto.NewAuthKey(2, bytes.Repeat([]byte{1}, 256))
+	if _, err := decryptMessage(other, frame); err == nil {
+		t.Error("decryptMessage accepted a message encrypted with another key")
+	}
+}
+
+func TestReplayed(t *testing.T) {
+	s := &sessionState{received: newReceivedLog()}
+	msgId := clientMsgId(time.Now(), 0)
+	if s.replayed(msgId) {
+		t.Fatal("new msg_id reported as replayed")
+	}
+	if got := s.checkSeqNo(msgId, 1); got != 0 {
+		t.Fatalf("checkSeqNo = %d", got)
+	}
+	if !s.replayed(msgId) {
+		t.Error("accepted msg_id not reported as replayed")
+	}
+	if s.replayed(msgId + 4) {
+		t.Error("next msg_id reported as replayed")
+	}
+}
+
+func TestContainerValidatesInnerMessages(t *testing.T) {
+	const sessionId = 4242
+	now := time.Now()
+	saltManagers.Store(testAuthKey().AuthKeyId(), testSaltManager(now))
+	defer saltManagers.Delete(testAuthKey().AuthKeyId())
+	cp := &ConnProp{authKey: testAuthKey()}
+	cp.beginBatch()
+
+	ping := func(msgId int64, seqNo int32) *mtproto.TLMessage2 {
+		return &mtproto.TLMessage2{MsgId: msgId, Seqno: seqNo, Object: &mtproto.TLPing{PingId: msgId}}
+	}
+	first, second := clientMsgId(now, 0), clientMsgId(now, 4)
+	tests := []struct {
+		name    string
+		msg     *mtproto.TLMessage2
+		wantAck bool
+	}{
+		{"valid", ping(first, 1), true},
+		{"duplicate", ping(first, 1), false},
+		{"bad parity", ping(second+1, 3), false},
+		{"too old", ping(clientMsgId(now.Add(-time.Hour), 0), 3), false},
+		{"seqno too low", ping(second, 1), false},
+		{"next valid", ping(second, 3), true},
+	}
+	for _, tt := range tests {
+		cp.pendingAcks = nil
+		cp.dispatch(&mtproto.TLMsgContainer{Messages: []*mtproto.TLMessage2{tt.msg}}, clientMsgId(now, 8), 100, sessionId)
+		if acked := len(cp.pendingAcks) == 1 && cp.pendingAcks[0] == tt.msg.MsgId; acked != tt.wantAck {
+			t.Errorf("%s: acked = %v, want %v", tt.name, acked, tt.wantAck)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/teamgram/proto/mtproto"
+)
+
+// HandleDestroySession handles TL_destroy_session requests. The session's
+// state, including messages still waiting for acks, is dropped; the session
+// the request came in can't destroy itself.
+func (cp *ConnProp) HandleDestroySession(obj *mtproto.TLDestroySession, msgId, salt, sessionId int64) {
+	target := obj.GetSessionId()
+	res := &mtproto.DestroySessionRes{SessionId: target}
+	if target == sessionId {
+		cp.encodeAndSend(mtproto.MakeTLDestroySessionNone(res), msgId, salt, sessionId, 32)
+		return
+	}
+
+	_, known := sessionStates.LoadAndDelete(sessionKey{cp.authKey.AuthKeyId(), target})
+	recorded, err := ForgetSessionID(cp.userAuthKeyID(), target)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to destroy session %d: %v\n", cp.connID, target, err)
+	}
+	if !known && !recorded {
+		logf(1, "[Conn %d] destroy_session: session %d unknown\n", cp.connID, target)
+		cp.encodeAndSend(mtproto.MakeTLDestroySessionNone(res), msgId, salt, sessionId, 32)
+		return
+	}
+	logf(1, "[Conn %d] Destroyed session %d\n", cp.connID, target)
+	cp.encodeAndSend(mtproto.MakeTLDestroySessionOk(res), msgId, salt, sessionId, 32)
+}
+
+// HandleDestroyAuthKey handles TL_destroy_auth_key requests. The key is
+// deleted with its session, which logs its user out, and every connection
+// using it is closed, this one once the answer is written.
+func (cp *ConnProp) HandleDestroyAuthKey(obj *mtproto.TLDestroyAuthKey, msgId, salt, sessionId int64) {
+	authKeyID := cp.authKey.AuthKeyId()
+	existed, err := DeleteAuthKey(authKeyID)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to destroy auth key %d: %v\n", cp.connID, authKeyID, err)
+		cp.encodeAndSend(mtproto.MakeTLDestroyAuthKeyFail(nil), msgId, salt, sessionId, 32)
+		return
+	}
+	if !existed {
+		cp.encodeAndSend(mtproto.MakeTLDestroyAuthKeyNone(nil), msgId, salt, sessionId, 32)
+		return
+	}
+	logf(1, "[Conn %d] Destroyed auth key %d (user %d)\n", cp.connID, authKeyID, cp.userID)
+	cp.encodeAndSend(mtproto.MakeTLDestroyAuthKeyOk(nil), msgId, salt, sessionId, 32)
+
+	forgetAuthKey(authKeyID)
+	activeConnections.Range(func(_, v interface{}) bool {
+		other := v.(*ConnProp)
+		if other == cp {
+			return true
+		}
+		other.mu.Lock()
+		uses := other.authKey != nil && (other.authKey.AuthKeyId() == authKeyID || other.userAuthKeyID() == authKeyID)
+		other.mu.Unlock()
+		if uses {
+			logf(1, "[Conn %d] Closing connection: auth key %d destroyed\n", other.connID, authKeyID)
+			other.conn.Close()
+		}
+		return true
+	})
+	cp.setUserID(0)
+	cp.closeAfterFlush = true
+}
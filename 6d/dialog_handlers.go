@@ -10,6 +10,7 @@ func (cp *ConnProp) HandleMessagesGetDialogs(obj *mtproto.TLMessagesGetDialogs,
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
@@ -8,6 +8,7 @@ require (
 	github.com/teamgram/proto v0.201.2
 	github.com/zeromicro/go-zero v1.8.4
 	go.mongodb.org/mongo-driver v1.17.4
+	google.golang.org/protobuf v1.36.5
 )
 
 require (
@@ -27,5 +28,4 @@ require (
 	golang.org/x/text v0.22.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240701130421-f6361c86f094 // indirect
 	google.golang.org/grpc v1.65.0 // indirect
-	google.golang.org/protobuf v1.36.5 // indirect
 )
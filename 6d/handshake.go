@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/teamgram/marmota/pkg/hack"
+	"github.com/teamgram/proto/mtproto"
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+// rsaKey is a server RSA key clients may encrypt p_q_inner_data with.
+type rsaKey struct {
+	fingerprint int64
+	key         *rsa.PrivateKey
+}
+
+// rsaKeys are loaded at startup from RSA_KEY_FILES, a comma separated list of
+// PEM files (default ./server_pkcs1.key). resPQ offers all of them.
+var rsaKeys []*rsaKey
+
+// loadRSAKeys reads the server RSA keys and computes their fingerprints.
+func loadRSAKeys() error {
+	files := os.Getenv("RSA_KEY_FILES")
+	if files == "" {
+		files = "./server_pkcs1.key"
+	}
+	var keys []*rsaKey
+	for _, file := range strings.Split(files, ",") {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+		key, err := readRSAKey(file)
+		if err != nil {
+			return fmt.Errorf("failed to load RSA key %s: %w", file, err)
+		}
+		fp := rsaFingerprint(&key.PublicKey)
+		if findRSAKey(keys, fp) != nil {
+			return fmt.Errorf("RSA key %s is listed twice", file)
+		}
+		keys = append(keys, &rsaKey{fingerprint: fp, key: key})
+		logf(1, "Loaded RSA key %s (fingerprint %d)\n", file, fp)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no RSA keys configured")
+	}
+	rsaKeys = keys
+	return nil
+}
+
+func readRSAKey(file string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA key")
+	}
+	return key, nil
+}
+
+// rsaFingerprint is the lower 64 bits of the SHA1 of the serialized
+// rsa_public_key n:bytes e:bytes.
+func rsaFingerprint(pub *rsa.PublicKey) int64 {
+	x := mtproto.NewEncodeBuf(512)
+	x.StringBytes(pub.N.Bytes())
+	x.StringBytes(big.NewInt(int64(pub.E)).Bytes())
+	hash := sha1.Sum(x.GetBuf())
+	return int64(binary.LittleEndian.Uint64(hash[12:20]))
+}
+
+func findRSAKey(keys []*rsaKey, fingerprint int64) *rsaKey {
+	for _, k := range keys {
+		if k.fingerprint == fingerprint {
+			return k
+		}
+	}
+	return nil
+}
+
+func rsaFingerprints() []int64 {
+	fps := make([]int64, len(rsaKeys))
+	for i, k := range rsaKeys {
+		fps[i] = k.fingerprint
+	}
+	return fps
+}
+
+// decryptInnerData recovers the serialized p_q_inner_data, with its padding,
+// from the RSA_PAD encrypted_data of req_DH_params.
+func (k *rsaKey) decryptInnerData(encrypted []byte) ([]byte, error) {
+	if len(encrypted) != 256 {
+		return nil, fmt.Errorf("encrypted_data of %d bytes", len(encrypted))
+	}
+	c := new(big.Int).SetBytes(encrypted)
+	if c.Cmp(k.key.N) >= 0 {
+		return nil, fmt.Errorf("encrypted_data is not below the modulus")
+	}
+	plain := make([]byte, 256)
+	new(big.Int).Exp(c, k.key.D, k.key.N).FillBytes(plain)
+
+	data := decodeRSAPad(plain)
+	if data == nil {
+		return nil, fmt.Errorf("RSA_PAD hash mismatch")
+	}
+	return data, nil
+}
+
+// decodeRSAPad undoes RSA_PAD: temp_key_xor(32) + aes_encrypted(224), where
+// aes_encrypted holds reversed data_with_padding(192) followed by
+// SHA256(temp_key + data_with_padding).
+func decodeRSAPad(plain []byte) []byte {
+	tempKey := sha256.Sum256(plain[32:])
+	for i := range tempKey {
+		tempKey[i] ^= plain[i]
+	}
+	dataWithHash, err := crypto.NewAES256IGECryptor(tempKey[:], zeroIV).Decrypt(plain[32:])
+	if err != nil {
+		return nil
+	}
+	data := make([]byte, 192)
+	for i := range data {
+		data[i] = dataWithHash[191-i]
+	}
+	if !bytes.Equal(sha256Concat(tempKey[:], data), dataWithHash[192:]) {
+		return nil
+	}
+	return data
+}
+
+// newPQ returns a fresh pq for resPQ: the product of two random 31 bit primes
+// p < q, big endian.
+func newPQ() (pq, p, q []byte, err error) {
+	bp, err := rand.Prime(rand.Reader, 31)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bq, err := rand.Prime(rand.Reader, 31)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch bp.Cmp(bq) {
+	case 0:
+		return newPQ()
+	case 1:
+		bp, bq = bq, bp
+	}
+	return new(big.Int).Mul(bp, bq).Bytes(), bp.Bytes(), bq.Bytes(), nil
+}
+
+// handshakeTimeout bounds each step of the DH handshake. A client that takes
+// longer to answer has to start over with req_pq_multi.
+const handshakeTimeout = 30 * time.Second
+
+// maxDHRetries is how many times a handshake may be answered with
+// dh_gen_retry before it fails.
+const maxDHRetries = 3
+
+type handshakeStage int
+
+const (
+	stageResPQSent    handshakeStage = iota + 1 // Waiting for req_DH_params
+	stageDHParamsSent                           // Waiting for set_client_DH_params
+)
+
+// handshake is the state of the DH key exchange in progress on a connection.
+type handshake struct {
+	stage    handshakeStage
+	deadline time.Time
+
+	nonce       []byte
+	serverNonce []byte
+	pq, p, q    string // Sent in resPQ, big endian
+
+	newNonce  []byte
+	a         *big.Int // Server DH secret
+	keyType   int      // mtproto.AuthKeyTypePerm, Temp or MediaTemp
+	expiresIn int32    // Lifetime of a temp key, in seconds
+
+	retries int
+	retryID int64 // auth_key_aux_hash of the key last refused with dh_gen_retry
+}
+
+// expect checks that the handshake is at stage and has not timed out.
+func (h *handshake) expect(stage handshakeStage) error {
+	if h == nil || h.stage != stage {
+		return fmt.Errorf("unexpected message")
+	}
+	if time.Now().After(h.deadline) {
+		return fmt.Errorf("timed out")
+	}
+	return nil
+}
+
+// advance moves the handshake to stage and restarts its timeout.
+func (h *handshake) advance(stage handshakeStage) {
+	h.stage = stage
+	h.deadline = time.Now().Add(handshakeTimeout)
+}
+
+// dhSafetyMargin is 2^{2048-64}: g_a and g_b must lie in
+// [dhSafetyMargin, p - dhSafetyMargin].
+var dhSafetyMargin = new(big.Int).Lsh(big.NewInt(1), 2048-64)
+
+// dhValueSafe reports whether a DH public value passes the checks of the
+// MTProto security guidelines.
+func dhValueSafe(x *big.Int) bool {
+	pMinusOne := new(big.Int).Sub(gBigIntDH2048P, big.NewInt(1))
+	if x.Cmp(big.NewInt(1)) <= 0 || x.Cmp(pMinusOne) >= 0 {
+		return false
+	}
+	upper := new(big.Int).Sub(gBigIntDH2048P, dhSafetyMargin)
+	return x.Cmp(dhSafetyMargin) >= 0 && x.Cmp(upper) <= 0
+}
+
+// newDHSecret picks the server's secret a with a safe g_a.
+func newDHSecret() (a, gA *big.Int) {
+	for {
+		a = new(big.Int).SetBytes(crypto.GenerateNonce(256))
+		gA = new(big.Int).Exp(gBigIntDH2048G, a, gBigIntDH2048P)
+		if dhValueSafe(gA) {
+			return a, gA
+		}
+	}
+}
+
+// tmpAesKeyIV derives the key and iv encrypting server_DH_inner_data and
+// client_DH_inner_data from new_nonce and server_nonce.
+func tmpAesKeyIV(newNonce, serverNonce []byte) (key, iv []byte) {
+	concat := func(a, b []byte) [20]byte {
+		return sha1.Sum(append(append(make([]byte, 0, len(a)+len(b)), a...), b...))
+	}
+	sha1A := concat(newNonce, serverNonce)
+	sha1B := concat(serverNonce, newNonce)
+	sha1C := concat(newNonce, newNonce)
+
+	key = append(append(key, sha1A[:]...), sha1B[:12]...)
+	iv = append(append(append(iv, sha1B[12:]...), sha1C[:]...), newNonce[:4]...)
+	return key, iv
+}
+
+// handleHandshake runs one unencrypted message of the DH handshake. An error
+// means the client broke the protocol and the connection must be closed.
+func (cp *ConnProp) handleHandshake(payload []byte) error {
+	// Unencrypted message: auth_key_id(8) = 0, msg_id(8), length(4), body
+	if len(payload) < 20 {
+		return fmt.Errorf("message of %d bytes", len(payload))
+	}
+
+	_, obj, err := parseFromIncomingMessage(payload[8:])
+	if obj == nil {
+		return fmt.Errorf("undecodable message: %v", err)
+	}
+	logf(1, "[Conn %d] Handshake: %T\n", cp.connID, obj)
+	switch obj := obj.(type) {
+	case *mtproto.TLReqPqMulti:
+		if !ipLimits.allowHandshake(cp.ip) {
+			cp.sendTransportError(transportErrFlood)
+			return fmt.Errorf("too many handshakes from %s", cp.ip)
+		}
+		err = cp.handleReqPqMulti(obj)
+	case *mtproto.TLReq_DHParams:
+		err = cp.handleReqDHParams(obj)
+	case *mtproto.TLSetClient_DHParams:
+		err = cp.handleSetClientDHParams(obj)
+	default:
+		err = fmt.Errorf("unexpected %T", obj)
+	}
+	if err != nil {
+		cp.hs = nil
+	}
+	return err
+}
+
+// handleReqPqMulti starts a handshake, answering with a fresh pq and the
+// fingerprints of the server keys.
+func (cp *ConnProp) handleReqPqMulti(obj *mtproto.TLReqPqMulti) error {
+	if len(obj.Nonce) != 16 {
+		return fmt.Errorf("req_pq_multi: nonce of %d bytes", len(obj.Nonce))
+	}
+	pq, p, q, err := newPQ()
+	if err != nil {
+		return fmt.Errorf("req_pq_multi: generate pq: %v", err)
+	}
+
+	hs := &handshake{
+		nonce:       obj.Nonce,
+		serverNonce: crypto.GenerateNonce(16),
+		pq:          string(pq),
+		p:           string(p),
+		q:           string(q),
+	}
+	hs.advance(stageResPQSent)
+	cp.hs = hs
+
+	cp.sendHandshakeRes(mtproto.MakeTLResPQ(&mtproto.ResPQ{
+		Nonce:                       hs.nonce,
+		ServerNonce:                 hs.serverNonce,
+		Pq:                          hs.pq,
+		ServerPublicKeyFingerprints: rsaFingerprints(),
+	}).To_ResPQ())
+	return nil
+}
+
+// handleReqDHParams checks the client's p_q_inner_data and answers with the
+// server's half of the DH exchange.
+func (cp *ConnProp) handleReqDHParams(obj *mtproto.TLReq_DHParams) error {
+	hs := cp.hs
+	if err := hs.expect(stageResPQSent); err != nil {
+		return fmt.Errorf("req_DH_params: %v", err)
+	}
+	if !bytes.Equal(obj.Nonce, hs.nonce) || !bytes.Equal(obj.ServerNonce, hs.serverNonce) {
+		return fmt.Errorf("req_DH_params: wrong nonce")
+	}
+	if obj.P != hs.p || obj.Q != hs.q {
+		return fmt.Errorf("req_DH_params: wrong p, q")
+	}
+	key := findRSAKey(rsaKeys, obj.PublicKeyFingerprint)
+	if key == nil {
+		return fmt.Errorf("req_DH_params: unknown public key fingerprint %d", obj.PublicKeyFingerprint)
+	}
+	data, err := key.decryptInnerData([]byte(obj.EncryptedData))
+	if err != nil {
+		return fmt.Errorf("req_DH_params: %v", err)
+	}
+
+	var inner *mtproto.P_QInnerData
+	switch o := mtproto.NewDecodeBuf(data).Object().(type) {
+	case *mtproto.TLPQInnerData:
+		hs.keyType = mtproto.AuthKeyTypePerm
+		inner = o.To_P_QInnerData()
+	case *mtproto.TLPQInnerDataDc:
+		hs.keyType = mtproto.AuthKeyTypePerm
+		inner = o.To_P_QInnerData()
+	case *mtproto.TLPQInnerDataTemp:
+		hs.keyType = mtproto.AuthKeyTypeTemp
+		hs.expiresIn = o.GetExpiresIn()
+		inner = o.To_P_QInnerData()
+	case *mtproto.TLPQInnerDataTempDc:
+		hs.keyType = mtproto.AuthKeyTypeTemp
+		if o.GetDc() < 0 {
+			hs.keyType = mtproto.AuthKeyTypeMediaTemp
+		}
+		hs.expiresIn = o.GetExpiresIn()
+		inner = o.To_P_QInnerData()
+	default:
+		return fmt.Errorf("req_DH_params: undecodable p_q_inner_data")
+	}
+	if !bytes.Equal(inner.GetNonce(), hs.nonce) || !bytes.Equal(inner.GetServerNonce(), hs.serverNonce) {
+		return fmt.Errorf("req_DH_params: wrong nonce in p_q_inner_data")
+	}
+	if inner.GetPq() != hs.pq || inner.GetP() != hs.p || inner.GetQ() != hs.q {
+		return fmt.Errorf("req_DH_params: wrong pq in p_q_inner_data")
+	}
+	if len(inner.GetNewNonce()) != 32 {
+		return fmt.Errorf("req_DH_params: new_nonce of %d bytes", len(inner.GetNewNonce()))
+	}
+	if hs.keyType != mtproto.AuthKeyTypePerm && hs.expiresIn <= 0 {
+		return fmt.Errorf("req_DH_params: temp key expiring in %d seconds", hs.expiresIn)
+	}
+	hs.newNonce = inner.GetNewNonce()
+
+	var gA *big.Int
+	hs.a, gA = newDHSecret()
+	serverDHInnerData := mtproto.MakeTLServer_DHInnerData(&mtproto.Server_DHInnerData{
+		Constructor: mtproto.TLConstructor(mtproto.TLConstructor_CRC32_server_DH_inner_data),
+		Nonce:       hs.nonce,
+		ServerNonce: hs.serverNonce,
+		G:           int32(dh2048G[0]),
+		GA:          string(gA.Bytes()),
+		DhPrime:     string(dh2048P),
+		ServerTime:  int32(time.Now().Unix()),
+	})
+	x := mtproto.NewEncodeBuf(512)
+	serverDHInnerData.Encode(x, 0)
+	innerBuf := x.GetBuf()
+
+	// answer_with_hash: SHA1(answer) + answer + padding to 16 bytes
+	answer := make([]byte, (20+len(innerBuf)+15)/16*16)
+	hash := sha1.Sum(innerBuf)
+	copy(answer, hash[:])
+	copy(answer[20:], innerBuf)
+	copy(answer[20+len(innerBuf):], crypto.GenerateNonce(len(answer)-20-len(innerBuf)))
+	aesKey, aesIV := tmpAesKeyIV(hs.newNonce, hs.serverNonce)
+	encrypted, err := crypto.NewAES256IGECryptor(aesKey, aesIV).Encrypt(answer)
+	if err != nil {
+		return fmt.Errorf("req_DH_params: encrypt answer: %v", err)
+	}
+
+	hs.advance(stageDHParamsSent)
+	cp.sendHandshakeRes(mtproto.MakeTLServer_DHParamsOk(&mtproto.Server_DH_Params{
+		Constructor:     mtproto.TLConstructor(mtproto.TLConstructor_CRC32_server_DH_params_ok),
+		Nonce:           hs.nonce,
+		ServerNonce:     hs.serverNonce,
+		EncryptedAnswer: hack.String(encrypted),
+	}).To_Server_DH_Params())
+	return nil
+}
+
+// handleSetClientDHParams checks the client's g_b and creates the auth key,
+// answering dh_gen_ok, dh_gen_retry if the key's id is taken, or dh_gen_fail
+// if g_b is not safe.
+func (cp *ConnProp) handleSetClientDHParams(obj *mtproto.TLSetClient_DHParams) error {
+	hs := cp.hs
+	if err := hs.expect(stageDHParamsSent); err != nil {
+		return fmt.Errorf("set_client_DH_params: %v", err)
+	}
+	if !bytes.Equal(obj.Nonce, hs.nonce) || !bytes.Equal(obj.ServerNonce, hs.serverNonce) {
+		return fmt.Errorf("set_client_DH_params: wrong nonce")
+	}
+
+	// data_with_hash: SHA1(client_DH_inner_data) + client_DH_inner_data + padding
+	encrypted := []byte(obj.EncryptedData)
+	if len(encrypted) < 32 || len(encrypted)%16 != 0 {
+		return fmt.Errorf("set_client_DH_params: encrypted_data of %d bytes", len(encrypted))
+	}
+	aesKey, aesIV := tmpAesKeyIV(hs.newNonce, hs.serverNonce)
+	decrypted, err := crypto.NewAES256IGECryptor(aesKey, aesIV).Decrypt(encrypted)
+	if err != nil {
+		return fmt.Errorf("set_client_DH_params: decrypt: %v", err)
+	}
+	dBuf := mtproto.NewDecodeBuf(decrypted[20:])
+	inner, ok := dBuf.Object().(*mtproto.TLClient_DHInnerData)
+	if !ok || dBuf.GetError() != nil {
+		return fmt.Errorf("set_client_DH_params: undecodable client_DH_inner_data")
+	}
+	innerLen := dBuf.GetOffset()
+	if len(decrypted)-20-innerLen >= 16 {
+		return fmt.Errorf("set_client_DH_params: %d bytes of padding", len(decrypted)-20-innerLen)
+	}
+	if hash := sha1.Sum(decrypted[20 : 20+innerLen]); !bytes.Equal(hash[:], decrypted[:20]) {
+		return fmt.Errorf("set_client_DH_params: client_DH_inner_data hash mismatch")
+	}
+	if !bytes.Equal(inner.GetNonce(), hs.nonce) || !bytes.Equal(inner.GetServerNonce(), hs.serverNonce) {
+		return fmt.Errorf("set_client_DH_params: wrong nonce in client_DH_inner_data")
+	}
+	if inner.GetRetryId() != hs.retryID {
+		return fmt.Errorf("set_client_DH_params: retry_id %d, expected %d", inner.GetRetryId(), hs.retryID)
+	}
+
+	gB := new(big.Int).SetBytes([]byte(inner.GetGB()))
+	authKey := make([]byte, 256)
+	new(big.Int).Exp(gB, hs.a, gBigIntDH2048P).FillBytes(authKey)
+	answer := &mtproto.SetClient_DHParamsAnswer{Nonce: hs.nonce, ServerNonce: hs.serverNonce}
+
+	if !dhValueSafe(gB) {
+		answer.NewNonceHash3 = calcNewNonceHash(hs.newNonce, authKey, 0x03)
+		cp.sendHandshakeRes(mtproto.MakeTLDhGenFail(answer).To_SetClient_DHParamsAnswer())
+		return fmt.Errorf("set_client_DH_params: unsafe g_b")
+	}
+
+	keyHash := sha1.Sum(authKey)
+	authKeyId := int64(binary.LittleEndian.Uint64(keyHash[12:20]))
+	existing, err := LoadAuthKeyByID(authKeyId)
+	if err != nil {
+		answer.NewNonceHash3 = calcNewNonceHash(hs.newNonce, authKey, 0x03)
+		cp.sendHandshakeRes(mtproto.MakeTLDhGenFail(answer).To_SetClient_DHParamsAnswer())
+		return fmt.Errorf("set_client_DH_params: %v", err)
+	}
+	if existing != nil || authKeyId == 0 {
+		if hs.retries >= maxDHRetries {
+			answer.NewNonceHash3 = calcNewNonceHash(hs.newNonce, authKey, 0x03)
+			cp.sendHandshakeRes(mtproto.MakeTLDhGenFail(answer).To_SetClient_DHParamsAnswer())
+			return fmt.Errorf("set_client_DH_params: auth_key_id %d taken after %d retries", authKeyId, hs.retries)
+		}
+		logf(1, "[Conn %d] Handshake: auth_key_id %d is taken, asking for another g_b\n", cp.connID, authKeyId)
+		hs.retries++
+		hs.retryID = int64(binary.LittleEndian.Uint64(keyHash[:8]))
+		hs.advance(stageDHParamsSent)
+		answer.NewNonceHash2 = calcNewNonceHash(hs.newNonce, authKey, 0x02)
+		cp.sendHandshakeRes(mtproto.MakeTLDhGenRetry(answer).To_SetClient_DHParamsAnswer())
+		return nil
+	}
+
+	// Save auth key to MongoDB
+	doc := &AuthKeyDoc{AuthKeyID: authKeyId, AuthKey: authKey}
+	if hs.keyType != mtproto.AuthKeyTypePerm {
+		doc.Temp = true
+		doc.Media = hs.keyType == mtproto.AuthKeyTypeMediaTemp
+		doc.ExpiresAt = time.Now().Add(time.Duration(hs.expiresIn) * time.Second)
+	}
+	if err := SaveAuthKey(doc); err != nil {
+		answer.NewNonceHash3 = calcNewNonceHash(hs.newNonce, authKey, 0x03)
+		cp.sendHandshakeRes(mtproto.MakeTLDhGenFail(answer).To_SetClient_DHParamsAnswer())
+		return fmt.Errorf("set_client_DH_params: %v", err)
+	}
+	if doc.Temp {
+		logf(1, "[Conn %d] Temp auth key created and saved to MongoDB: %d (media: %v, expires %s)\n", cp.connID, authKeyId, doc.Media, doc.ExpiresAt.Format(time.RFC3339))
+	} else {
+		logf(1, "[Conn %d] Auth key created and saved to MongoDB: %d\n", cp.connID, authKeyId)
+	}
+	cp.setAuthKey(newAuthKeyInfo(doc), 0)
+	authKeys.put(authKeyId, cp.keyInfo)
+
+	// First server salt: new_nonce[0:8] xor server_nonce[0:8]
+	setInitialServerSalt(authKeyId, int64(binary.LittleEndian.Uint64(hs.newNonce[:8])^binary.LittleEndian.Uint64(hs.serverNonce[:8])))
+
+	cp.hs = nil
+	answer.NewNonceHash1 = calcNewNonceHash(hs.newNonce, authKey, 0x01)
+	cp.sendHandshakeRes(mtproto.MakeTLDhGenOk(answer).To_SetClient_DHParamsAnswer())
+	return nil
+}
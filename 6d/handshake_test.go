@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+func TestNewPQ(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		pq, p, q, err := newPQ()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp, bq := new(big.Int).SetBytes(p), new(big.Int).SetBytes(q)
+		if bp.Cmp(bq) >= 0 {
+			t.Errorf("p %v is not below q %v", bp, bq)
+		}
+		if !bp.ProbablyPrime(20) || !bq.ProbablyPrime(20) {
+			t.Errorf("p %v or q %v is not prime", bp, bq)
+		}
+		if new(big.Int).Mul(bp, bq).Cmp(new(big.Int).SetBytes(pq)) != 0 {
+			t.Errorf("pq %x is not p*q", pq)
+		}
+		if len(pq) != 8 {
+			t.Errorf("pq has %d bytes, want 8", len(pq))
+		}
+	}
+}
+
+// writeTestRSAKey writes a new RSA key to a PEM file in dir.
+func writeTestRSAKey(t *testing.T, dir, name string) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file, key
+}
+
+func TestLoadRSAKeys(t *testing.T) {
+	defer func(keys []*rsaKey) { rsaKeys = keys }(rsaKeys)
+	dir := t.TempDir()
+	first, firstKey := writeTestRSAKey(t, dir, "first.key")
+	second, _ := writeTestRSAKey(t, dir, "second.key")
+
+	tests := []struct {
+		name    string
+		files   string
+		wantErr bool
+		wantN   int
+	}{
+		{"one key", first, false, 1},
+		{"two keys", first + ", " + second, false, 2},
+		{"same key twice", first + "," + first, true, 0},
+		{"missing file", filepath.Join(dir, "missing.key"), true, 0},
+		{"no keys", " , ", true, 0},
+	}
+	for _, tt := range tests {
+		rsaKeys = nil
+		t.Setenv("RSA_KEY_FILES", tt.files)
+		err := loadRSAKeys()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if len(rsaKeys) != tt.wantN {
+			t.Errorf("%s: %d keys loaded, want %d", tt.name, len(rsaKeys), tt.wantN)
+		}
+	}
+
+	rsaKeys = nil
+	t.Setenv("RSA_KEY_FILES", first+","+second)
+	if err := loadRSAKeys(); err != nil {
+		t.Fatal(err)
+	}
+	fp := rsaFingerprint(&firstKey.PublicKey)
+	if k := findRSAKey(rsaKeys, fp); k == nil || k.key.N.Cmp(firstKey.N) != 0 {
+		t.Errorf("fingerprint %d does not find its key", fp)
+	}
+	if findRSAKey(rsaKeys, fp+1) != nil {
+		t.Error("unknown fingerprint found a key")
+	}
+	if fps := rsaFingerprints(); len(fps) != 2 || fps[0] != fp {
+		t.Errorf("rsaFingerprints = %v", fps)
+	}
+}
+
+// encryptRSAPad encrypts data (at most 144 bytes) the way a client encrypts
+// p_q_inner_data.
+func encryptRSAPad(t *testing.T, pub *rsa.PublicKey, data []byte) []byte {
+	for {
+		withPadding := append(append([]byte(nil), data...), crypto.GenerateNonce(192-len(data))...)
+		tempKey := crypto.GenerateNonce(32)
+		dataWithHash := make([]byte, 192, 224)
+		for i := range withPadding {
+			dataWithHash[i] = withPadding[191-i]
+		}
+		dataWithHash = append(dataWithHash, sha256Concat(tempKey, withPadding)...)
+		aesEncrypted, err := crypto.NewAES256IGECryptor(tempKey, zeroIV).Encrypt(dataWithHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tempKeyXor := sha256Concat(aesEncrypted, nil)
+		for i := range tempKeyXor {
+			tempKeyXor[i] ^= tempKey[i]
+		}
+		m := new(big.Int).SetBytes(append(tempKeyXor, aesEncrypted...))
+		if m.Cmp(pub.N) >= 0 {
+			continue
+		}
+		encrypted := make([]byte, 256)
+		new(big.Int).Exp(m, big.NewInt(int64(pub.E)), pub.N).FillBytes(encrypted)
+		return encrypted
+	}
+}
+
+func TestDecryptInnerData(t *testing.T) {
+	dir := t.TempDir()
+	_, key := writeTestRSAKey(t, dir, "server.key")
+	k := &rsaKey{fingerprint: rsaFingerprint(&key.PublicKey), key: key}
+	data := bytes.Repeat([]byte{0x42}, 96)
+
+	tests := []struct {
+		name      string
+		encrypted func() []byte
+		wantErr   bool
+	}{
+		{"valid", func() []byte { return encryptRSAPad(t, &key.PublicKey, data) }, false},
+		{"tampered", func() []byte {
+			e := encryptRSAPad(t, &key.PublicKey, data)
+			e[100] ^= 1
+			return e
+		}, true},
+		{"short", func() []byte { return encryptRSAPad(t, &key.PublicKey, data)[1:] }, true},
+		{"not below the modulus", func() []byte {
+			return bytes.Repeat([]byte{0xff}, 256)
+		}, true},
+	}
+	for _, tt := range tests {
+		got, err := k.decryptInnerData(tt.encrypted())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !bytes.Equal(got[:len(data)], data) {
+			t.Errorf("%s: decrypted data does not start with the original", tt.name)
+		}
+	}
+}
+
+func TestDHValueSafe(t *testing.T) {
+	p := gBigIntDH2048P
+	tests := []struct {
+		name string
+		x    *big.Int
+		want bool
+	}{
+		{"zero", big.NewInt(0), false},
+		{"one", big.NewInt(1), false},
+		{"small", big.NewInt(3), false},
+		{"below the margin", new(big.Int).Sub(dhSafetyMargin, big.NewInt(1)), false},
+		{"lower bound", dhSafetyMargin, true},
+		{"middle", new(big.Int).Rsh(p, 1), true},
+		{"upper bound", new(big.Int).Sub(p, dhSafetyMargin), true},
+		{"above the margin", new(big.Int).Sub(p, new(big.Int).Sub(dhSafetyMargin, big.NewInt(1))), false},
+		{"p - 1", new(big.Int).Sub(p, big.NewInt(1)), false},
+		{"p", p, false},
+	}
+	for _, tt := range tests {
+		if got := dhValueSafe(tt.x); got != tt.want {
+			t.Errorf("%s: dhValueSafe = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	a, gA := newDHSecret()
+	if !dhValueSafe(gA) || new(big.Int).Exp(gBigIntDH2048G, a, p).Cmp(gA) != 0 {
+		t.Error("newDHSecret returned an unsafe or wrong g_a")
+	}
+}
+
+func TestHandshakeExpect(t *testing.T) {
+	started := &handshake{}
+	started.advance(stageResPQSent)
+	timedOut := &handshake{}
+	timedOut.advance(stageDHParamsSent)
+	timedOut.deadline = timedOut.deadline.Add(-handshakeTimeout - time.Second)
+
+	tests := []struct {
+		name    string
+		h       *handshake
+		stage   handshakeStage
+		wantErr bool
+	}{
+		{"no handshake", nil, stageResPQSent, true},
+		{"expected stage", started, stageResPQSent, false},
+		{"skipped stage", started, stageDHParamsSent, true},
+		{"timed out", timedOut, stageDHParamsSent, true},
+	}
+	for _, tt := range tests {
+		if err := tt.h.expect(tt.stage); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expect = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTmpAesKeyIV(t *testing.T) {
+	newNonce, serverNonce := crypto.GenerateNonce(32), crypto.GenerateNonce(16)
+	key, iv := tmpAesKeyIV(newNonce, serverNonce)
+	if len(key) != 32 || len(iv) != 32 {
+		t.Fatalf("key of %d and iv of %d bytes, want 32 each", len(key), len(iv))
+	}
+	if !bytes.Equal(iv[28:], newNonce[:4]) {
+		t.Error("iv does not end with new_nonce[0:4]")
+	}
+	if otherKey, _ := tmpAesKeyIV(newNonce, crypto.GenerateNonce(16)); bytes.Equal(key, otherKey) {
+		t.Error("key does not depend on server_nonce")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+const (
+	maxInvokeDepth   = 8  // Nested wrappers peeled off a single query at most
+	maxParkedQueries = 64 // invokeAfterMsg queries a session may keep waiting
+)
+
+// invokeOptions collects what the wrappers around a query asked for.
+type invokeOptions struct {
+	layer          int32 // invokeWithLayer: API layer of the client
+	initConnection *mtproto.TLInitConnection
+	afterMsgIds    []int64 // invokeAfterMsg(s): run only once these are processed
+	withoutUpdates bool    // invokeWithoutUpdates: don't push updates to this connection
+	takeoutId      int64   // invokeWithTakeout
+	messagesRange  *mtproto.MessageRange
+}
+
+// parkedQuery is an invokeAfterMsg query waiting for the messages it depends on.
+type parkedQuery struct {
+	msgId int64
+	salt  int64
+	after []int64
+	query mtproto.TLObject
+}
+
+// unwrapQuery peels gzip_packed, invokeWithLayer, initConnection and the
+// other invoke* wrappers off a query and returns the query to dispatch
+// together with the wrappers' options. Objects without a wrapper are
+// returned as is.
+func unwrapQuery(o mtproto.TLObject) (mtproto.TLObject, invokeOptions, error) {
+	var opts invokeOptions
+	for depth := 0; depth < maxInvokeDepth; depth++ {
+		var query []byte
+		switch obj := o.(type) {
+		case *mtproto.TLGzipPacked:
+			if obj.Obj == nil {
+				return nil, opts, fmt.Errorf("empty gzip_packed")
+			}
+			o = obj.Obj
+			continue
+		case *mtproto.TLInvokeWithLayer:
+			opts.layer = obj.Layer
+			query = obj.Query
+		case *mtproto.TLInitConnection:
+			opts.initConnection = obj
+			query = obj.Query
+		case *mtproto.TLInvokeAfterMsg:
+			opts.afterMsgIds = append(opts.afterMsgIds, obj.MsgId)
+			query = obj.Query
+		case *mtproto.TLInvokeAfterMsgs:
+			opts.afterMsgIds = append(opts.afterMsgIds, obj.MsgIds...)
+			query = obj.Query
+		case *mtproto.TLInvokeWithoutUpdates:
+			opts.withoutUpdates = true
+			query = obj.Query
+		case *mtproto.TLInvokeWithMessagesRange:
+			opts.messagesRange = obj.Range
+			query = obj.Query
+		case *mtproto.TLInvokeWithTakeout:
+			opts.takeoutId = obj.TakeoutId
+			query = obj.Query
+		default:
+			return o, opts, nil
+		}
+
+		dBuf := mtproto.NewDecodeBuf(query)
+		inner := dBuf.Object()
+		if err := dBuf.GetError(); err != nil {
+			return nil, opts, fmt.Errorf("decode query of %T: %v", o, err)
+		}
+		if inner == nil {
+			return nil, opts, fmt.Errorf("empty query in %T", o)
+		}
+		o = inner
+	}
+	return nil, opts, fmt.Errorf("more than %d nested wrappers", maxInvokeDepth)
+}
+
+// isServiceMessage reports whether o is an MTProto service message rather
+// than an RPC query.
+func isServiceMessage(o mtproto.TLObject) bool {
+	switch o.(type) {
+	case *mtproto.TLPing, *mtproto.TLPingDelayDisconnect,
+		*mtproto.TLMsgsAck, *mtproto.TLMsgsStateReq, *mtproto.TLMsgResendReq,
+		*mtproto.TLMsgsAllInfo, *mtproto.TLGetFutureSalts,
+		*mtproto.TLDestroySession, *mtproto.TLDestroyAuthKey, *mtproto.TLMsgContainer:
+		return true
+	}
+	return false
+}
+
+// dispatch runs one incoming message: it unwraps the query, holds it back
+// while the messages named by invokeAfterMsg(s) are not processed yet, and
+// hands it to replyMsg. Queries waiting for this one run right after it.
+func (cp *ConnProp) dispatch(o mtproto.TLObject, msgId, salt, sessionId int64) {
+	cp.applyLogOut()
+	query, opts, err := unwrapQuery(o)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to unwrap msg %d: %v\n", cp.connID, msgId, err)
+		cp.sendRpcError(mtproto.ErrInputRequestInvalid, msgId, salt, sessionId)
+		return
+	}
+	if query != o {
+		logf(1, "In query %T (wrapped in %T)\n", query, o)
+	}
+	if opts.takeoutId != 0 || opts.messagesRange != nil {
+		logf(2, "[Conn %d] Query %d with takeout %d, messages range %v\n", cp.connID, msgId, opts.takeoutId, opts.messagesRange)
+	}
+
+	if opts.layer != 0 {
+		if !supportedLayer(opts.layer) {
+			logf(1, "[Conn %d] Unsupported client layer %d (supported %d-%d)\n", cp.connID, opts.layer, minLayer, maxLayer)
+			cp.sendRpcError(mtproto.ErrConnectionLayerInvalid, msgId, salt, sessionId)
+			return
+		}
+		cp.setLayer(opts.layer, sessionId)
+		logf(1, "[Conn %d] Client layer %d\n", cp.connID, opts.layer)
+	}
+	if ic := opts.initConnection; ic != nil {
+		logf(1, "[Conn %d] initConnection api_id=%d device=%q system=%q app=%q lang=%s/%s\n",
+			cp.connID, ic.ApiId, ic.DeviceModel, ic.SystemVersion, ic.AppVersion, ic.LangPack, ic.LangCode)
+		cp.mu.Lock()
+		layer := cp.layer
+		cp.mu.Unlock()
+		cp.saveClientInfo(ic, layer)
+	}
+
+	// A connection stops getting updates once it uses invokeWithoutUpdates
+	// and gets them again with its next plain query.
+	if !isServiceMessage(query) {
+		cp.mu.Lock()
+		cp.withoutUpdates = opts.withoutUpdates
+		cp.mu.Unlock()
+	}
+
+	state := getSessionState(cp.authKey.AuthKeyId(), sessionId)
+	if len(opts.afterMsgIds) > 0 && !state.park(&parkedQuery{msgId, salt, opts.afterMsgIds, query}) {
+		logf(1, "[Conn %d] Query %d waits for %v\n", cp.connID, msgId, opts.afterMsgIds)
+		return
+	}
+
+	cp.replyMsg(query, msgId, salt, sessionId)
+	cp.complete(state, msgId, sessionId)
+}
+
+// complete marks msgId as processed and runs the parked queries that were
+// only waiting for it.
+func (cp *ConnProp) complete(state *sessionState, msgId, sessionId int64) {
+	for _, q := range state.finish(msgId) {
+		logf(1, "[Conn %d] Running query %d after %v\n", cp.connID, q.msgId, q.after)
+		cp.replyMsg(q.query, q.msgId, q.salt, sessionId)
+		cp.complete(state, q.msgId, sessionId)
+	}
+}
+
+// processedLocked reports whether the client message msgId no longer holds
+// up queries depending on it: it was processed, or it is too old to be known.
+// Callers hold s.mu.
+func (s *sessionState) processedLocked(msgId int64) bool {
+	if s.received.done[msgId] {
+		return true
+	}
+	if _, ok := s.received.content[msgId]; ok {
+		return false
+	}
+	return msgId <= s.received.floor
+}
+
+// readyLocked reports whether every message q depends on is processed.
+// Callers hold s.mu.
+func (s *sessionState) readyLocked(q *parkedQuery) bool {
+	for _, id := range q.after {
+		if !s.processedLocked(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// park keeps q until all messages it depends on are processed. It returns
+// true if q can run right away instead.
+func (s *sessionState) park(q *parkedQuery) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readyLocked(q) {
+		return true
+	}
+
+	if len(s.parked) >= maxParkedQueries {
+		logf(1, "Dropping query %d of session %d: too many waiting queries\n", s.parked[0].msgId, s.sessionID)
+		s.parked = s.parked[1:]
+	}
+	s.parked = append(s.parked, q)
+	return false
+}
+
+// finish marks msgId as processed and removes and returns the parked
+// queries that can run now, oldest first.
+func (s *sessionState) finish(msgId int64) []*parkedQuery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.received.content[msgId]; ok {
+		s.received.done[msgId] = true
+	}
+
+	var ready []*parkedQuery
+	waiting := s.parked[:0]
+	for _, q := range s.parked {
+		if s.readyLocked(q) {
+			ready = append(ready, q)
+		} else {
+			waiting = append(waiting, q)
+		}
+	}
+	s.parked = waiting
+	return ready
+}
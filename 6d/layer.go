@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// defaultLayer is used to encode responses until the client tells its layer
+// with invokeWithLayer.
+const defaultLayer = 158
+
+// minLayer and maxLayer bound the API layers clients may use (MIN_LAYER,
+// MAX_LAYER). Queries from other layers are refused with
+// CONNECTION_LAYER_INVALID. The defaults cover what the mtproto package can
+// encode.
+var minLayer, maxLayer = func() (int32, int32) {
+	min, max := envLayer("MIN_LAYER", 133), envLayer("MAX_LAYER", 201)
+	if min > max {
+		log.Fatalf("MIN_LAYER %d is above MAX_LAYER %d", min, max)
+	}
+	return min, max
+}()
+
+func envLayer(name string, def int32) int32 {
+	envVal := os.Getenv(name)
+	if envVal == "" {
+		return def
+	}
+	layer, err := strconv.Atoi(envVal)
+	if err != nil || layer <= 0 {
+		log.Fatalf("Invalid %s: %q", name, envVal)
+	}
+	return int32(layer)
+}
+
+func supportedLayer(layer int32) bool {
+	return layer >= minLayer && layer <= maxLayer
+}
+
+// setLayer records the layer the client negotiated for this connection and
+// its session, so later connections of the session encode the same way.
+func (cp *ConnProp) setLayer(layer int32, sessionId int64) {
+	cp.mu.Lock()
+	cp.layer = layer
+	cp.mu.Unlock()
+
+	s := getSessionState(cp.authKey.AuthKeyId(), sessionId)
+	s.mu.Lock()
+	s.layer = layer
+	s.mu.Unlock()
+}
+
+// encodeLayer returns the layer to encode responses for this connection with:
+// the one negotiated on the connection, else the one known for its session,
+// else defaultLayer.
+func (cp *ConnProp) encodeLayer() int32 {
+	cp.mu.Lock()
+	layer, sessionId, authKey := cp.layer, cp.sessionID, cp.authKey
+	cp.mu.Unlock()
+	if layer != 0 {
+		return layer
+	}
+
+	if authKey != nil && sessionId != 0 {
+		s := getSessionState(authKey.AuthKeyId(), sessionId)
+		s.mu.Lock()
+		layer = s.layer
+		s.mu.Unlock()
+		if layer != 0 {
+			return layer
+		}
+	}
+	return defaultLayer
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+const (
+	// loginTokenTTL is how long a QR login token can be scanned; clients
+	// export a new one when it runs out
+	loginTokenTTL = 30 * time.Second
+	// acceptedLoginTokenTTL is how long the exporting client has to collect
+	// an accepted token
+	acceptedLoginTokenTTL = 2 * time.Minute
+)
+
+// loginToken is a QR login token exported by a client that is not logged in.
+// Another session of a logged in user accepts it by scanning the QR code.
+type loginToken struct {
+	mu        sync.Mutex
+	authKeyID int64   // auth key that exported the token and gets logged in
+	exceptIDs []int64 // users already logged in on the exporting client
+	expiresAt time.Time
+	userID    int64 // who accepted it, 0 until then
+}
+
+var loginTokens sync.Map // string(token) -> *loginToken
+
+// findLoginToken returns the live token for raw. It sends the RPC error and
+// returns nil if there is none.
+func (cp *ConnProp) findLoginToken(raw []byte, msgId, salt, sessionId int64) *loginToken {
+	v, ok := loginTokens.Load(string(raw))
+	if !ok {
+		cp.sendRpcError(mtproto.ErrAuthTokenInvalid, msgId, salt, sessionId)
+		return nil
+	}
+	t := v.(*loginToken)
+	t.mu.Lock()
+	expired := time.Now().After(t.expiresAt)
+	t.mu.Unlock()
+	if expired {
+		loginTokens.Delete(string(raw))
+		cp.sendRpcError(mtproto.ErrAuthTokenExpired, msgId, salt, sessionId)
+		return nil
+	}
+	return t
+}
+
+// acceptedLoginToken returns the token of authKeyID that was accepted and is
+// waiting to be collected, if any.
+func acceptedLoginToken(authKeyID int64) (raw string, t *loginToken) {
+	loginTokens.Range(func(k, v interface{}) bool {
+		candidate := v.(*loginToken)
+		candidate.mu.Lock()
+		accepted := candidate.authKeyID == authKeyID && candidate.userID != 0
+		candidate.mu.Unlock()
+		if accepted {
+			raw, t = k.(string), candidate
+			return false
+		}
+		return true
+	})
+	return raw, t
+}
+
+// completeLoginToken logs the connection in as the user who accepted its
+// token and answers with auth.loginTokenSuccess.
+func (cp *ConnProp) completeLoginToken(raw string, t *loginToken, msgId, salt, sessionId int64) {
+	// Collected once, even if the client asks twice at the same time
+	if _, ok := loginTokens.LoadAndDelete(raw); !ok {
+		cp.sendRpcError(mtproto.ErrAuthTokenInvalid, msgId, salt, sessionId)
+		return
+	}
+	t.mu.Lock()
+	userID := t.userID
+	t.mu.Unlock()
+
+	user, err := FindUserByID(userID)
+	if err != nil || user == nil {
+		logf(1, "[Conn %d] Failed to load user %d for login token: %v\n", cp.connID, userID, err)
+		cp.sendRpcError(mtproto.ErrAuthTokenInvalid, msgId, salt, sessionId)
+		return
+	}
+	if user.Password != nil {
+		passwordLogins.Store(cp.userAuthKeyID(), &passwordLogin{
+			userID:    user.ID,
+			expiresAt: time.Now().Add(passwordLoginTTL),
+		})
+		logf(1, "[Conn %d] Login token accepted by user %d, who has a password\n", cp.connID, user.ID)
+		cp.sendRpcError(mtproto.ErrSessionPasswordNeeded, msgId, salt, sessionId)
+		return
+	}
+
+	cp.bindUser(user)
+	result := mtproto.MakeTLAuthLoginTokenSuccess(&mtproto.Auth_LoginToken{
+		Authorization: makeAuthAuthorization(user),
+	})
+	cp.encodeAndSend(result, msgId, salt, sessionId, 512)
+}
+
+func (cp *ConnProp) sendLoginToken(raw []byte, expiresAt time.Time, msgId, salt, sessionId int64) {
+	result := mtproto.MakeTLAuthLoginToken(&mtproto.Auth_LoginToken{
+		Expires: int32(expiresAt.Unix()),
+		Token:   raw,
+	})
+	cp.encodeAndSend(result, msgId, salt, sessionId, 128)
+}
+
+// HandleAuthExportLoginToken handles TL_auth_exportLoginToken requests. Once
+// the token was accepted the next call logs the client in.
+func (cp *ConnProp) HandleAuthExportLoginToken(obj *mtproto.TLAuthExportLoginToken, msgId, salt, sessionId int64) {
+	authKeyID := cp.userAuthKeyID()
+	if raw, t := acceptedLoginToken(authKeyID); t != nil {
+		cp.completeLoginToken(raw, t, msgId, salt, sessionId)
+		return
+	}
+	if cp.userID != 0 {
+		logf(1, "[Conn %d] Auth key already has user %d, ignoring exportLoginToken\n", cp.connID, cp.userID)
+		cp.sendRpcError(mtproto.ErrInputRequestInvalid, msgId, salt, sessionId)
+		return
+	}
+
+	// Only the newest token of an auth key can be scanned
+	loginTokens.Range(func(k, v interface{}) bool {
+		if v.(*loginToken).authKeyID == authKeyID {
+			loginTokens.Delete(k)
+		}
+		return true
+	})
+	raw := randomBytes(32)
+	t := &loginToken{
+		authKeyID: authKeyID,
+		exceptIDs: obj.GetExceptIds(),
+		expiresAt: time.Now().Add(loginTokenTTL),
+	}
+	loginTokens.Store(string(raw), t)
+	logf(1, "[Conn %d] Exported login token for auth key %d\n", cp.connID, authKeyID)
+
+	cp.sendLoginToken(raw, t.expiresAt, msgId, salt, sessionId)
+}
+
+// HandleAuthImportLoginToken handles TL_auth_importLoginToken requests. There
+// is a single DC, so this only collects a token exported on this auth key.
+func (cp *ConnProp) HandleAuthImportLoginToken(obj *mtproto.TLAuthImportLoginToken, msgId, salt, sessionId int64) {
+	t := cp.findLoginToken(obj.GetToken(), msgId, salt, sessionId)
+	if t == nil {
+		return
+	}
+	if t.authKeyID != cp.userAuthKeyID() {
+		cp.sendRpcError(mtproto.ErrAuthTokenInvalid, msgId, salt, sessionId)
+		return
+	}
+	t.mu.Lock()
+	accepted, expiresAt := t.userID != 0, t.expiresAt
+	t.mu.Unlock()
+	if !accepted {
+		cp.sendLoginToken(obj.GetToken(), expiresAt, msgId, salt, sessionId)
+		return
+	}
+	cp.completeLoginToken(string(obj.GetToken()), t, msgId, salt, sessionId)
+}
+
+// HandleAuthAcceptLoginToken handles TL_auth_acceptLoginToken requests: a
+// logged in session approves a scanned token, and the session that exported
+// it is told with updateLoginToken to collect its login.
+func (cp *ConnProp) HandleAuthAcceptLoginToken(obj *mtproto.TLAuthAcceptLoginToken, msgId, salt, sessionId int64) {
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+	t := cp.findLoginToken(obj.GetToken(), msgId, salt, sessionId)
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	if t.userID != 0 {
+		t.mu.Unlock()
+		cp.sendRpcError(mtproto.ErrAuthTokenAlreadyAccepted, msgId, salt, sessionId)
+		return
+	}
+	// The exporting client is already logged in as this user
+	for _, id := range t.exceptIDs {
+		if id == cp.userID {
+			t.mu.Unlock()
+			cp.sendRpcError(mtproto.ErrAuthTokenAlreadyAccepted, msgId, salt, sessionId)
+			return
+		}
+	}
+	t.userID = cp.userID
+	t.expiresAt = time.Now().Add(acceptedLoginTokenTTL)
+	t.mu.Unlock()
+	logf(1, "[Conn %d] User %d accepted login token of auth key %d\n", cp.connID, cp.userID, t.authKeyID)
+
+	update := mtproto.MakeTLUpdateLoginToken(nil).To_Update()
+	pushUpdatesToAuthKey(t.authKeyID, makeUpdatesEnvelope(update))
+
+	// Describe the new session as account.getAuthorizations will
+	session, err := FindSessionByAuthKey(t.authKeyID)
+	if err != nil || session == nil {
+		session = &SessionDoc{AuthKeyID: t.authKeyID, CreatedAt: time.Now(), LastUsedAt: time.Now()}
+	}
+	cp.encodeAndSend(mtproto.MakeTLAuthorization(makeAuthorization(session, false)), msgId, salt, sessionId, 512)
+}
+
+// expireLoginTokens drops login tokens that were not scanned or collected in
+// time.
+func expireLoginTokens() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		loginTokens.Range(func(k, v interface{}) bool {
+			t := v.(*loginToken)
+			t.mu.Lock()
+			expired := now.After(t.expiresAt)
+			t.mu.Unlock()
+			if expired {
+				loginTokens.Delete(k)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcceptedLoginToken(t *testing.T) {
+	tokens := map[string]*loginToken{
+		"pending":  {authKeyID: 1, expiresAt: time.Now().Add(time.Minute)},
+		"accepted": {authKeyID: 2, expiresAt: time.Now().Add(time.Minute), userID: 10},
+		"other":    {authKeyID: 3, expiresAt: time.Now().Add(time.Minute), userID: 20},
+	}
+	for raw, tok := range tokens {
+		loginTokens.Store(raw, tok)
+		defer loginTokens.Delete(raw)
+	}
+
+	tests := []struct {
+		authKeyID int64
+		wantRaw   string
+	}{
+		{1, ""},
+		{2, "accepted"},
+		{3, "other"},
+		{4, ""},
+	}
+	for _, tt := range tests {
+		raw, tok := acceptedLoginToken(tt.authKeyID)
+		if raw != tt.wantRaw {
+			t.Errorf("acceptedLoginToken(%d) = %q, want %q", tt.authKeyID, raw, tt.wantRaw)
+		}
+		if (tok != nil) != (tt.wantRaw != "") || tok != nil && tok != tokens[raw] {
+			t.Errorf("acceptedLoginToken(%d) returned the wrong token", tt.authKeyID)
+		}
+	}
+}
@@ -15,6 +15,7 @@ func (cp *ConnProp) HandleContactsImportContacts(obj *mtproto.TLContactsImportCo
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
@@ -98,6 +99,7 @@ func (cp *ConnProp) HandleContactsGetContactsDB(obj *mtproto.TLContactsGetContac
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
@@ -196,12 +198,14 @@ func (cp *ConnProp) HandleMessagesGetHistory(obj *mtproto.TLMessagesGetHistory,
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
 	peer := obj.GetPeer()
 	if peer == nil {
 		logf(1, "[Conn %d] No peer in request\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -226,6 +230,7 @@ func (cp *ConnProp) HandleMessagesGetHistory(obj *mtproto.TLMessagesGetHistory,
 		return
 	default:
 		logf(1, "[Conn %d] Unknown peer type: %s\n", cp.connID, peer.PredicateName)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -330,6 +335,7 @@ func (cp *ConnProp) HandleMessagesSendMessage(obj *mtproto.TLMessagesSendMessage
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
@@ -339,6 +345,7 @@ func (cp *ConnProp) HandleMessagesSendMessage(obj *mtproto.TLMessagesSendMessage
 
 	if peer == nil {
 		logf(1, "[Conn %d] No peer in request\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -348,6 +355,7 @@ func (cp *ConnProp) HandleMessagesSendMessage(obj *mtproto.TLMessagesSendMessage
 		peerUserID = peer.UserId
 	default:
 		logf(1, "[Conn %d] Unknown peer type: %s\n", cp.connID, peer.PredicateName)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -369,11 +377,28 @@ func (cp *ConnProp) HandleMessagesSendMessage(obj *mtproto.TLMessagesSendMessage
 		return
 	}
 
+	if message == "" {
+		logf(1, "[Conn %d] Empty message\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrMessageEmpty, msgId, salt, sessionId)
+		return
+	}
+
+	if peerUser, err := FindUserByID(peerUserID); err != nil {
+		logf(1, "[Conn %d] Failed to look up peer %d: %v\n", cp.connID, peerUserID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	} else if peerUser == nil {
+		logf(1, "[Conn %d] Peer %d does not exist\n", cp.connID, peerUserID)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
+		return
+	}
+
 	dialogID := GetDialogID(cp.userID, peerUserID)
 
 	messageID, err := GetNextMessageID(dialogID)
 	if err != nil {
 		logf(1, "[Conn %d] Failed to get next message ID: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
 		return
 	}
 
@@ -381,16 +406,26 @@ func (cp *ConnProp) HandleMessagesSendMessage(obj *mtproto.TLMessagesSendMessage
 
 	UpdateUserLastSeen(cp.userID)
 
-	ptsCount := int32(1)
-
-	newPts, err := IncrementUserPts(cp.userID, ptsCount)
-	if err != nil {
-		logf(1, "[Conn %d] Failed to increment pts: %v\n", cp.connID, err)
+	// Journal the message for the sender; this allocates the sender's pts
+	now := int32(time.Now().Unix())
+	senderEntry := &UpdateLogDoc{
+		UserID:     cp.userID,
+		Type:       UpdateTypeNewMessage,
+		Date:       now,
+		PeerUserID: peerUserID,
+		MessageID:  messageID,
+		FromID:     cp.userID,
+		Out:        true,
+		Message:    message,
+	}
+	if err := AppendUserUpdate(senderEntry); err != nil {
+		logf(1, "[Conn %d] Failed to journal message for sender: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
 		return
 	}
+	newPts, ptsCount := senderEntry.Pts, senderEntry.PtsCount
 
 	// Save message to database
-	now := int32(time.Now().Unix())
 	msgDoc := &MessageDoc{
 		ID:       messageID,
 		DialogID: dialogID,
@@ -521,19 +556,42 @@ func (cp *ConnProp) HandleMessagesSendMessage(obj *mtproto.TLMessagesSendMessage
 	}
 
 	cp.encodeAndSend(result, msgId, salt, sessionId, 4096)
+
+	// Journal the message for the recipient at the recipient's own pts
+	recipientEntry := &UpdateLogDoc{
+		UserID:     peerUserID,
+		Type:       UpdateTypeNewMessage,
+		Date:       now,
+		PeerUserID: cp.userID,
+		MessageID:  messageID,
+		FromID:     cp.userID,
+		Out:        false,
+		Message:    message,
+	}
+	if err := AppendUserUpdate(recipientEntry); err != nil {
+		logf(1, "[Conn %d] Failed to journal message for recipient: %v\n", cp.connID, err)
+	} else {
+		// Deliver the message in real time: the recipient sees it as incoming,
+		// the sender's other sessions see it as outgoing.
+		pushUpdatesToUser(peerUserID, makeUpdateShortMessage(messageID, cp.userID, false, message, recipientEntry.Pts, recipientEntry.PtsCount, now), nil)
+	}
+	pushUpdatesToUser(cp.userID, makeUpdateShortMessage(messageID, peerUserID, true, message, newPts, ptsCount, now), cp)
 }
+
 // HandleMessagesGetScheduledHistory handles TL_messages_getScheduledHistory requests
 func (cp *ConnProp) HandleMessagesGetScheduledHistory(obj *mtproto.TLMessagesGetScheduledHistory, msgId, salt, sessionId int64) {
 	logf(1, "[Conn %d] messages.getScheduledHistory for user %d\n", cp.connID, cp.userID)
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
 	peer := obj.GetPeer()
 	if peer == nil {
 		logf(1, "[Conn %d] No peer in request\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -546,6 +604,7 @@ func (cp *ConnProp) HandleMessagesGetScheduledHistory(obj *mtproto.TLMessagesGet
 		peerUserID = cp.userID
 	default:
 		logf(1, "[Conn %d] Unknown peer type: %s\n", cp.connID, peer.PredicateName)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -593,12 +652,14 @@ func (cp *ConnProp) HandleMessagesSearch(obj *mtproto.TLMessagesSearch, msgId, s
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
 	peer := obj.GetPeer()
 	if peer == nil {
 		logf(1, "[Conn %d] No peer in request\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -647,6 +708,7 @@ func (cp *ConnProp) HandleMessagesSetTyping(obj *mtproto.TLMessagesSetTyping, ms
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
@@ -656,6 +718,7 @@ func (cp *ConnProp) HandleMessagesSetTyping(obj *mtproto.TLMessagesSetTyping, ms
 
 	if peer == nil {
 		logf(1, "[Conn %d] No peer in setTyping request\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -705,6 +768,7 @@ func (cp *ConnProp) HandleMessagesGetMessagesReactions(obj *mtproto.TLMessagesGe
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
@@ -761,12 +825,14 @@ func (cp *ConnProp) HandleMessagesReadHistory(obj *mtproto.TLMessagesReadHistory
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
 	peer := obj.GetPeer()
 	if peer == nil {
 		logf(1, "[Conn %d] No peer in request\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -792,6 +858,7 @@ func (cp *ConnProp) HandleMessagesReadHistory(obj *mtproto.TLMessagesReadHistory
 		return
 	default:
 		logf(1, "[Conn %d] Unknown peer type: %s\n", cp.connID, peer.PredicateName)
+		cp.sendRpcError(mtproto.ErrPeerIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -846,18 +913,39 @@ func (cp *ConnProp) HandleMessagesReadHistory(obj *mtproto.TLMessagesReadHistory
 		logf(1, "[Conn %d] Failed to update peer's read_outbox status: %v\n", cp.connID, err)
 	}
 
-	// Get current pts
-	pts, _, _, _, err := GetUserState(cp.userID)
-	if err != nil {
-		pts = 1
+	// Journal the read for the reader (inbox) and for the peer (outbox)
+	inboxEntry := &UpdateLogDoc{
+		UserID:     cp.userID,
+		Type:       UpdateTypeReadHistoryInbox,
+		PeerUserID: peerUserID,
+		MaxID:      maxID,
+	}
+	if err := AppendUserUpdate(inboxEntry); err != nil {
+		logf(1, "[Conn %d] Failed to journal read inbox: %v\n", cp.connID, err)
+		pts, _, _, _, _ := GetUserState(cp.userID)
+		inboxEntry.Pts, inboxEntry.PtsCount = pts, 0
+	} else {
+		pushUpdatesToUser(cp.userID, makeUpdatesEnvelope(inboxEntry.ToUpdate()), cp)
+	}
+
+	outboxEntry := &UpdateLogDoc{
+		UserID:     peerUserID,
+		Type:       UpdateTypeReadHistoryOutbox,
+		PeerUserID: cp.userID,
+		MaxID:      maxID,
+	}
+	if err := AppendUserUpdate(outboxEntry); err != nil {
+		logf(1, "[Conn %d] Failed to journal read outbox for peer: %v\n", cp.connID, err)
+	} else {
+		pushUpdatesToUser(peerUserID, makeUpdatesEnvelope(outboxEntry.ToUpdate()), nil)
 	}
 
 	result := &mtproto.TLMessagesAffectedMessages{
 		Data2: &mtproto.Messages_AffectedMessages{
 			PredicateName: "messages_affectedMessages",
 			Constructor:   -2066640507,
-			Pts:           pts,
-			PtsCount:      0,
+			Pts:           inboxEntry.Pts,
+			PtsCount:      inboxEntry.PtsCount,
 		},
 	}
 
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+// serverDcID is the DC id obfuscated clients must ask for in their init header
+// (test DCs add 10000, media-only connections negate it). It defaults to 0,
+// which accepts any DC id: a single server answers for every DC the client
+// may pick.
+var serverDcID = func() int {
+	if envVal := os.Getenv("SERVER_DC_ID"); envVal != "" {
+		if dc, err := strconv.Atoi(envVal); err == nil {
+			return dc
+		}
+	}
+	return 0
+}()
+
+// proxySecret is the optional MTProxy-style secret (MTPROXY_SECRET, 32 hex
+// chars, optionally prefixed with "dd" to only allow padded intermediate).
+// When set, only obfuscated connections derived from it are accepted.
+var proxySecret, proxySecretPaddedOnly = func() ([]byte, bool) {
+	envVal := os.Getenv("MTPROXY_SECRET")
+	if envVal == "" {
+		return nil, false
+	}
+	secret, err := hex.DecodeString(envVal)
+	if err != nil {
+		log.Fatalf("Invalid MTPROXY_SECRET: %v", err)
+	}
+	switch {
+	case len(secret) == 16:
+		return secret, false
+	case len(secret) == 17 && secret[0] == 0xdd:
+		return secret[1:], true
+	}
+	log.Fatalf("Unsupported MTPROXY_SECRET: expected 16 bytes or dd + 16 bytes, got %d bytes", len(secret))
+	return nil, false
+}()
+
+// newObfuscated2Codec derives the AES-CTR codec of an obfuscated2 connection
+// from its 64-byte init header and validates the protocol tag and DC id the
+// header carries. The header itself is consumed by the decryptor, so the
+// codec is positioned at the first byte after it.
+func newObfuscated2Codec(header []byte, secret []byte) (codec *AesCTR128Crypto, tag uint32, dcID int16, err error) {
+	if len(header) != 64 {
+		return nil, 0, 0, fmt.Errorf("obfuscated2 header must be 64 bytes, got %d", len(header))
+	}
+
+	// Client -> server: key header[8:40], iv header[40:56]
+	// Server -> client: the same 48 bytes reversed
+	var reversed [48]byte
+	for i := 0; i < 48; i++ {
+		reversed[i] = header[55-i]
+	}
+
+	decryptKey := append([]byte(nil), header[8:40]...)
+	encryptKey := append([]byte(nil), reversed[:32]...)
+	if secret != nil {
+		decryptKey = sha256Concat(decryptKey, secret)
+		encryptKey = sha256Concat(encryptKey, secret)
+	}
+
+	decryptor, err := crypto.NewAesCTR128Encrypt(decryptKey, header[40:56])
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	encryptor, err := crypto.NewAesCTR128Encrypt(encryptKey, reversed[32:48])
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	codec = newAesCTR128Crypto(decryptor, encryptor)
+
+	decrypted := codec.Decrypt(append([]byte(nil), header...))
+	tag = binary.LittleEndian.Uint32(decrypted[56:60])
+	dcID = int16(binary.LittleEndian.Uint16(decrypted[60:62]))
+
+	switch tag {
+	case transportAbridged, transportIntermediate, transportPaddedIntermediate:
+	default:
+		return nil, 0, 0, fmt.Errorf("unsupported obfuscated transport tag 0x%08x", tag)
+	}
+	if secret != nil && proxySecretPaddedOnly && tag != transportPaddedIntermediate {
+		return nil, 0, 0, fmt.Errorf("secret requires padded intermediate, got %s", transportName(tag))
+	}
+	if !validDcID(dcID) {
+		return nil, 0, 0, fmt.Errorf("unknown dc id %d", dcID)
+	}
+	return codec, tag, dcID, nil
+}
+
+// validDcID reports whether dcID from an init header addresses this server.
+func validDcID(dcID int16) bool {
+	if serverDcID == 0 {
+		return true
+	}
+	dc := int(dcID)
+	if dc < 0 {
+		dc = -dc // Media-only connection
+	}
+	if dc > 10000 {
+		dc -= 10000 // Test DC
+	}
+	return dc == serverDcID
+}
+
+func sha256Concat(a, b []byte) []byte {
+	h := sha256.New()
+	h.Write(a)
+	h.Write(b)
+	return h.Sum(nil)
+}
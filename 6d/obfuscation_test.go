@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+// clientObfuscated2 builds the init header a client sends for tag and dcID and
+// returns it with the client's side of the codec.
+func clientObfuscated2(t *testing.T, tag uint32, dcID int16, secret []byte) ([]byte, *AesCTR128Crypto) {
+	init := crypto.GenerateNonce(64)
+	binary.LittleEndian.PutUint32(init[56:60], tag)
+	binary.LittleEndian.PutUint16(init[60:62], uint16(dcID))
+
+	var reversed [48]byte
+	for i := 0; i < 48; i++ {
+		reversed[i] = init[55-i]
+	}
+	encryptKey := append([]byte(nil), init[8:40]...)
+	decryptKey := append([]byte(nil), reversed[:32]...)
+	if secret != nil {
+		encryptKey = sha256Concat(encryptKey, secret)
+		decryptKey = sha256Concat(decryptKey, secret)
+	}
+	encryptor, err := crypto.NewAesCTR128Encrypt(encryptKey, init[40:56])
+	if err != nil {
+		t.Fatal(err)
+	}
+	decryptor, err := crypto.NewAesCTR128Encrypt(decryptKey, reversed[32:48])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := encryptor.Encrypt(append([]byte(nil), init...))
+	header := append(init[:56:56], encrypted[56:]...)
+	return header, newAesCTR128Crypto(decryptor, encryptor)
+}
+
+func TestObfuscated2Codec(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x5a}, 16)
+	defer func(dc int) { serverDcID = dc }(serverDcID)
+	defer func(paddedOnly bool) { proxySecretPaddedOnly = paddedOnly }(proxySecretPaddedOnly)
+
+	tests := []struct {
+		name         string
+		serverDC     int
+		paddedOnly   bool
+		tag          uint32
+		dcID         int16
+		clientSecret []byte
+		serverSecret []byte
+		wantErr      bool
+	}{
+		{"abridged", 0, false, transportAbridged, 2, nil, nil, false},
+		{"intermediate", 0, false, transportIntermediate, 2, nil, nil, false},
+		{"padded intermediate", 0, false, transportPaddedIntermediate, 2, nil, nil, false},
+		{"unknown tag", 0, false, 0x01020304, 2, nil, nil, true},
+		{"any dc by default", 0, false, transportAbridged, -10004, nil, nil, false},
+		{"own dc", 2, false, transportAbridged, 2, nil, nil, false},
+		{"own media dc", 2, false, transportAbridged, -2, nil, nil, false},
+		{"own test dc", 2, false, transportAbridged, 10002, nil, nil, false},
+		{"other dc", 2, false, transportAbridged, 3, nil, nil, true},
+		{"secret", 0, false, transportIntermediate, 2, secret, secret, false},
+		{"wrong secret", 0, false, transportIntermediate, 2, bytes.Repeat([]byte{1}, 16), secret, true},
+		{"secret required", 0, false, transportIntermediate, 2, nil, secret, true},
+		{"dd secret with padded intermediate", 0, true, transportPaddedIntermediate, 2, secret, secret, false},
+		{"dd secret with intermediate", 0, true, transportIntermediate, 2, secret, secret, true},
+	}
+	for _, tt := range tests {
+		serverDcID, proxySecretPaddedOnly = tt.serverDC, tt.paddedOnly
+		header, client := clientObfuscated2(t, tt.tag, tt.dcID, tt.clientSecret)
+		server, tag, dcID, err := newObfuscated2Codec(header, tt.serverSecret)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if tag != tt.tag || dcID != tt.dcID {
+			t.Errorf("%s: tag 0x%08x dc %d, want 0x%08x dc %d", tt.name, tag, dcID, tt.tag, tt.dcID)
+		}
+
+		// Both directions continue right after the header
+		for i := 0; i < 3; i++ {
+			data := crypto.GenerateNonce(100 + i)
+			if got := server.Decrypt(client.Encrypt(append([]byte(nil), data...))); !bytes.Equal(got, data) {
+				t.Errorf("%s: client to server chunk %d does not round-trip", tt.name, i)
+			}
+			if got := client.Decrypt(server.Encrypt(append([]byte(nil), data...))); !bytes.Equal(got, data) {
+				t.Errorf("%s: server to client chunk %d does not round-trip", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestObfuscated2CodecShortHeader(t *testing.T) {
+	if _, _, _, err := newObfuscated2Codec(make([]byte, 63), nil); err == nil {
+		t.Error("accepted a 63-byte header")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+const (
+	outboxMaxMessages = 1000       // Oldest unacknowledged messages are dropped beyond this
+	outboxMaxBody     = 128 * 1024 // Larger messages (file parts) are not kept for resending
+	receivedLogSize   = 1024       // Client msg_ids remembered for msgs_state_req
+)
+
+// msgs_state_info / msgs_all_info status bytes
+const (
+	msgStateUnknown     = 1  // Nothing known, msg_id too low
+	msgStateNotReceived = 2  // Within the stored range but never received
+	msgStateTooHigh     = 3  // Not received yet, msg_id higher than anything seen
+	msgStateReceived    = 4  // Received
+	msgStateNoAck       = 16 // Received message did not require an ack
+	msgStateRpcDone     = 32 // RPC query processed
+	msgStateResponded   = 64 // Content-related response already generated
+)
+
+// outboundMessage is a content-related server message kept until the client
+// acknowledges it, so it can be sent again with its original msg_id.
+type outboundMessage struct {
+	msgId    int64
+	seqNo    int32
+	body     []byte
+	reqMsgId int64 // Client request this is the rpc_result of, 0 otherwise
+	sentAt   time.Time
+}
+
+// receivedLog remembers the last receivedLogSize accepted client msg_ids.
+type receivedLog struct {
+	order     []int64
+	content   map[int64]bool // msg_id -> message was content-related
+	responded map[int64]bool // msg_id -> an rpc_result for it was generated
+	done      map[int64]bool // msg_id -> processing finished (for invokeAfterMsg)
+	floor     int64          // Highest msg_id dropped from the log
+}
+
+func newReceivedLog() receivedLog {
+	return receivedLog{
+		content:   make(map[int64]bool),
+		responded: make(map[int64]bool),
+		done:      make(map[int64]bool),
+	}
+}
+
+func (r *receivedLog) add(msgId int64, contentRelated bool) {
+	if _, ok := r.content[msgId]; ok {
+		return
+	}
+	r.order = append(r.order, msgId)
+	r.content[msgId] = contentRelated
+	if len(r.order) > receivedLogSize {
+		oldest := r.order[0]
+		r.order = r.order[1:]
+		if oldest > r.floor {
+			r.floor = oldest
+		}
+		delete(r.content, oldest)
+		delete(r.responded, oldest)
+		delete(r.done, oldest)
+	}
+}
+
+// keep stores a content-related message in the outbox. Callers hold s.mu.
+func (s *sessionState) keep(msgId int64, seqNo int32, body []byte) {
+	var reqMsgId int64
+	if len(body) >= 12 && int32(binary.LittleEndian.Uint32(body)) == -212046591 {
+		reqMsgId = int64(binary.LittleEndian.Uint64(body[4:12]))
+		if _, ok := s.received.content[reqMsgId]; ok {
+			s.received.responded[reqMsgId] = true
+		}
+	}
+	if len(body) > outboxMaxBody {
+		return
+	}
+
+	s.outbox[msgId] = &outboundMessage{
+		msgId:    msgId,
+		seqNo:    seqNo,
+		body:     body,
+		reqMsgId: reqMsgId,
+		sentAt:   time.Now(),
+	}
+
+	if len(s.outbox) > outboxMaxMessages {
+		oldest := msgId
+		for id := range s.outbox {
+			if id < oldest {
+				oldest = id
+			}
+		}
+		delete(s.outbox, oldest)
+	}
+}
+
+// ack drops server messages the client confirmed.
+func (s *sessionState) ack(msgIds []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range msgIds {
+		delete(s.outbox, id)
+	}
+}
+
+// pending returns the outbox messages with the given msg_ids, or all of them
+// if msgIds is nil, oldest first.
+func (s *sessionState) pending(msgIds []int64) []*outboundMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*outboundMessage
+	if msgIds == nil {
+		for _, m := range s.outbox {
+			msgs = append(msgs, m)
+		}
+	} else {
+		for _, id := range msgIds {
+			if m, ok := s.outbox[id]; ok {
+				msgs = append(msgs, m)
+			}
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].msgId < msgs[j].msgId })
+	return msgs
+}
+
+// stateOf returns the msgs_state_info status byte of a client msg_id.
+func (s *sessionState) stateOf(msgId int64) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if contentRelated, ok := s.received.content[msgId]; ok {
+		state := byte(msgStateReceived)
+		if !contentRelated {
+			state |= msgStateNoAck
+		}
+		if s.received.responded[msgId] {
+			state |= msgStateRpcDone | msgStateResponded
+		}
+		return state
+	}
+	switch {
+	case msgId > s.lastMsgID:
+		return msgStateTooHigh
+	case len(s.received.order) == 0 || msgId < s.received.order[0]:
+		return msgStateUnknown
+	}
+	return msgStateNotReceived
+}
+
+// resend writes kept messages again with their original msg_id and seqno.
+func (cp *ConnProp) resend(msgs []*outboundMessage, salt, sessionId int64) {
+	for _, m := range msgs {
+		logf(2, "[Conn %d] Resending msg %d (seqno %d, %d bytes)\n", cp.connID, m.msgId, m.seqNo, len(m.body))
+		cp.enqueue(m.msgId, m.seqNo, m.body, salt, sessionId)
+	}
+}
+
+// resendPending sends everything the client has not acknowledged yet in this
+// session, e.g. after it reconnected.
+func (cp *ConnProp) resendPending(salt, sessionId int64) {
+	msgs := getSessionState(cp.authKey.AuthKeyId(), sessionId).pending(nil)
+	if len(msgs) > 0 {
+		logf(1, "[Conn %d] Resending %d unacknowledged message(s) of session %d\n", cp.connID, len(msgs), sessionId)
+		cp.resend(msgs, salt, sessionId)
+	}
+}
+
+// HandleMsgsStateReq answers msgs_state_req with one status byte per msg_id.
+// Like future_salts, msgs_state_info is not wrapped in rpc_result.
+func (cp *ConnProp) HandleMsgsStateReq(obj *mtproto.TLMsgsStateReq, msgId, salt, sessionId int64) {
+	state := getSessionState(cp.authKey.AuthKeyId(), sessionId)
+	info := make([]byte, len(obj.GetMsgIds()))
+	for i, id := range obj.GetMsgIds() {
+		info[i] = state.stateOf(id)
+	}
+
+	result := &mtproto.TLMsgsStateInfo{
+		Data2: &mtproto.MsgsStateInfo{
+			PredicateName: "msgs_state_info",
+			Constructor:   81704317,
+			ReqMsgId:      msgId,
+			Info:          string(info),
+		},
+	}
+	buf := mtproto.NewEncodeBuf(32 + len(info))
+	if err := result.Encode(buf, cp.encodeLayer()); err != nil {
+		logf(1, "[Conn %d] Failed to encode msgs_state_info: %v\n", cp.connID, err)
+		return
+	}
+	cp.send(buf.GetBuf(), salt, sessionId)
+}
+
+// HandleMsgResendReq sends the requested server messages again if they are
+// still in the outbox.
+func (cp *ConnProp) HandleMsgResendReq(obj *mtproto.TLMsgResendReq, msgId, salt, sessionId int64) {
+	msgs := getSessionState(cp.authKey.AuthKeyId(), sessionId).pending(obj.GetMsgIds())
+	logf(1, "[Conn %d] msg_resend_req for %d message(s), %d still kept\n", cp.connID, len(obj.GetMsgIds()), len(msgs))
+	cp.resend(msgs, salt, sessionId)
+}
+
+// HandleMsgsAllInfo applies the client's view of our messages: received ones
+// are dropped from the outbox, ones it knows nothing about are sent again.
+func (cp *ConnProp) HandleMsgsAllInfo(obj *mtproto.TLMsgsAllInfo, msgId, salt, sessionId int64) {
+	state := getSessionState(cp.authKey.AuthKeyId(), sessionId)
+	ids, info := obj.GetMsgIds(), obj.GetInfo()
+
+	var received, missing []int64
+	for i, id := range ids {
+		if i >= len(info) {
+			break
+		}
+		switch st := info[i] & 7; {
+		case st == msgStateReceived:
+			received = append(received, id)
+		case st == msgStateUnknown || st == msgStateNotReceived:
+			missing = append(missing, id)
+		}
+	}
+
+	state.ack(received)
+	if len(missing) > 0 {
+		cp.resend(state.pending(missing), salt, sessionId)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"math/big"
+	"net/mail"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+	"github.com/teamgram/proto/mtproto/crypto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	// srpCheckTTL is how long the srp_B of account.getPassword can be used
+	srpCheckTTL = 5 * time.Minute
+	// passwordLoginTTL is how long a login that passed the phone code waits
+	// for auth.checkPassword
+	passwordLoginTTL = 15 * time.Minute
+	// maxPasswordAttempts is how many wrong passwords a login survives; after
+	// that the client has to sign in with a new phone code
+	maxPasswordAttempts = 5
+	// passwordLockout is how long the password settings of a user stay locked
+	// after maxPasswordAttempts wrong passwords
+	passwordLockout = 10 * time.Minute
+)
+
+// srpCheck is the server half of an SRP exchange started by
+// account.getPassword. Each one answers a single password check.
+type srpCheck struct {
+	userID    int64
+	verifier  []byte // the password it was made for
+	b, B      []byte
+	expiresAt time.Time
+}
+
+// passwordLogin is a sign in that got SESSION_PASSWORD_NEEDED and is waiting
+// for auth.checkPassword.
+type passwordLogin struct {
+	userID    int64
+	expiresAt time.Time
+	attempts  int32 // wrong passwords so far, updated atomically
+}
+
+// passwordFailures counts the wrong passwords a logged in user sent to the
+// password settings methods since first.
+type passwordFailures struct {
+	mu    sync.Mutex
+	first time.Time
+	count int
+}
+
+var (
+	srpChecks        sync.Map // srp_id -> *srpCheck
+	passwordLogins   sync.Map // auth key id -> *passwordLogin
+	settingsFailures sync.Map // user id -> *passwordFailures
+)
+
+// randomBytes reads n bytes from crypto/rand. crypto.RandomBytes is backed by
+// math/rand and must not be used for secrets or salts.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// passwordSRP returns the SRP parameters of a stored password. Passwords are
+// always set up with the 2048 bit group of the handshake.
+func passwordSRP(password *PasswordDoc) *crypto.SRPUtil {
+	return crypto.MakeSRPUtil(&crypto.PasswordKdfAlgoModPow{
+		Salt1: password.Salt1,
+		Salt2: password.Salt2,
+		G:     int32(dh2048G[0]),
+		P:     dh2048P,
+	})
+}
+
+func makePasswordKdfAlgo(salt1, salt2 []byte) *mtproto.PasswordKdfAlgo {
+	return mtproto.MakeTLPasswordKdfAlgoModPow(&mtproto.PasswordKdfAlgo{
+		Salt1: salt1,
+		Salt2: salt2,
+		G:     int32(dh2048G[0]),
+		P:     dh2048P,
+	}).To_PasswordKdfAlgo()
+}
+
+// passwordUser returns the user account.getPassword and
+// account.getPasswordSettings are about: the logged in one, or the one
+// waiting for auth.checkPassword on this auth key.
+func (cp *ConnProp) passwordUser() (*UserDoc, error) {
+	userID := cp.userID
+	if userID == 0 {
+		login := pendingPasswordLogin(cp.userAuthKeyID())
+		if login == nil {
+			return nil, nil
+		}
+		userID = login.userID
+	}
+	return FindUserByID(userID)
+}
+
+func pendingPasswordLogin(authKeyID int64) *passwordLogin {
+	v, ok := passwordLogins.Load(authKeyID)
+	if !ok {
+		return nil
+	}
+	login := v.(*passwordLogin)
+	if time.Now().After(login.expiresAt) {
+		passwordLogins.Delete(authKeyID)
+		return nil
+	}
+	return login
+}
+
+// verifyPassword checks the proof a client sent for the password of user and
+// returns the RPC error to answer with if it does not hold.
+func verifyPassword(user *UserDoc, check *mtproto.InputCheckPasswordSRP) error {
+	if check == nil || check.GetPredicateName() != mtproto.Predicate_inputCheckPasswordSRP {
+		if user.Password == nil {
+			return nil
+		}
+		return mtproto.ErrPasswordHashInvalid
+	}
+	if user.Password == nil {
+		return mtproto.ErrPasswordMissing
+	}
+
+	v, ok := srpChecks.LoadAndDelete(check.GetSrpId())
+	if !ok {
+		return mtproto.ErrSrpIdInvalid
+	}
+	srp := v.(*srpCheck)
+	if srp.userID != user.ID || time.Now().After(srp.expiresAt) {
+		return mtproto.ErrSrpIdInvalid
+	}
+	if !bytes.Equal(srp.verifier, user.Password.Verifier) {
+		return mtproto.ErrSrpPasswordChanged
+	}
+
+	m1 := passwordSRP(user.Password).CalcM(user.Password.Salt1, user.Password.Verifier, check.GetA(), srp.b, srp.B)
+	if m1 == nil || !hmac.Equal(m1, check.GetM1()) {
+		return mtproto.ErrPasswordHashInvalid
+	}
+	return nil
+}
+
+// HandleAccountGetPassword handles TL_account_getPassword requests
+func (cp *ConnProp) HandleAccountGetPassword(obj *mtproto.TLAccountGetPassword, msgId, salt, sessionId int64) {
+	user, err := cp.passwordUser()
+	if err != nil {
+		logf(1, "[Conn %d] Failed to load user: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	if user == nil {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+
+	// The client appends 32 random bytes of its own to salt1
+	password := &mtproto.Account_Password{
+		NewAlgo: makePasswordKdfAlgo(randomBytes(8), randomBytes(16)),
+		NewSecureAlgo: mtproto.MakeTLSecurePasswordKdfAlgoPBKDF2(&mtproto.SecurePasswordKdfAlgo{
+			Salt: randomBytes(8),
+		}).To_SecurePasswordKdfAlgo(),
+		SecureRandom: randomBytes(32),
+	}
+	if p := user.Password; p != nil {
+		srp := &srpCheck{
+			userID:    user.ID,
+			verifier:  p.Verifier,
+			b:         randomBytes(256),
+			expiresAt: time.Now().Add(srpCheckTTL),
+		}
+		srp.B = passwordSRP(p).CalcSRPB2(srp.b, p.Verifier)
+		srpID := GenerateAccessHash()
+		srpChecks.Store(srpID, srp)
+
+		password.HasPassword = true
+		password.HasRecovery = p.Email != ""
+		password.CurrentAlgo = makePasswordKdfAlgo(p.Salt1, p.Salt2)
+		password.Srp_B = srp.B
+		password.SrpId = &wrapperspb.Int64Value{Value: srpID}
+		if p.Hint != "" {
+			password.Hint = &wrapperspb.StringValue{Value: p.Hint}
+		}
+	}
+	logf(1, "[Conn %d] account.getPassword for user %d (has password: %v)\n", cp.connID, user.ID, password.HasPassword)
+
+	cp.encodeAndSend(mtproto.MakeTLAccountPassword(password), msgId, salt, sessionId, 1024)
+}
+
+// verifySettingsPassword is verifyPassword for the password settings methods
+// of a logged in user. After maxPasswordAttempts wrong passwords they answer
+// FLOOD_WAIT until passwordLockout has passed since the first one.
+func verifySettingsPassword(user *UserDoc, check *mtproto.InputCheckPasswordSRP) error {
+	now := time.Now()
+	v, _ := settingsFailures.LoadOrStore(user.ID, &passwordFailures{first: now})
+	failures := v.(*passwordFailures)
+
+	failures.mu.Lock()
+	defer failures.mu.Unlock()
+	if now.Sub(failures.first) >= passwordLockout {
+		failures.first, failures.count = now, 0
+	}
+	if failures.count >= maxPasswordAttempts {
+		wait := failures.first.Add(passwordLockout).Sub(now)
+		return mtproto.NewErrFloodWaitX(int32((wait + time.Second - 1) / time.Second))
+	}
+
+	err := verifyPassword(user, check)
+	if err == mtproto.ErrPasswordHashInvalid {
+		failures.count++
+	}
+	return err
+}
+
+// HandleAccountGetPasswordSettings handles TL_account_getPasswordSettings requests
+func (cp *ConnProp) HandleAccountGetPasswordSettings(obj *mtproto.TLAccountGetPasswordSettings, msgId, salt, sessionId int64) {
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+	user, err := FindUserByID(cp.userID)
+	if err != nil || user == nil {
+		logf(1, "[Conn %d] Failed to load user %d: %v\n", cp.connID, cp.userID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	if err := verifySettingsPassword(user, obj.GetPassword()); err != nil {
+		cp.sendRpcError(err, msgId, salt, sessionId)
+		return
+	}
+
+	settings := &mtproto.Account_PasswordSettings{}
+	if user.Password != nil && user.Password.Email != "" {
+		settings.Email = &wrapperspb.StringValue{Value: user.Password.Email}
+	}
+	cp.encodeAndSend(mtproto.MakeTLAccountPasswordSettings(settings), msgId, salt, sessionId, 256)
+}
+
+// HandleAccountUpdatePasswordSettings handles TL_account_updatePasswordSettings
+// requests: setting, changing and removing the password, and changing its
+// hint and recovery email.
+func (cp *ConnProp) HandleAccountUpdatePasswordSettings(obj *mtproto.TLAccountUpdatePasswordSettings, msgId, salt, sessionId int64) {
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+	user, err := FindUserByID(cp.userID)
+	if err != nil || user == nil {
+		logf(1, "[Conn %d] Failed to load user %d: %v\n", cp.connID, cp.userID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	if err := verifySettingsPassword(user, obj.GetPassword()); err != nil {
+		logf(1, "[Conn %d] account.updatePasswordSettings: %v\n", cp.connID, err)
+		cp.sendRpcError(err, msgId, salt, sessionId)
+		return
+	}
+
+	settings := obj.GetNewSettings()
+	if settings == nil {
+		cp.sendRpcError(mtproto.ErrNewSettingsInvalid, msgId, salt, sessionId)
+		return
+	}
+
+	var password *PasswordDoc
+	switch algo := settings.GetNewAlgo(); {
+	case algo == nil:
+		// Only the hint or the recovery email change
+		if user.Password == nil {
+			cp.sendRpcError(mtproto.ErrPasswordMissing, msgId, salt, sessionId)
+			return
+		}
+		updated := *user.Password
+		password = &updated
+	case algo.GetPredicateName() == mtproto.Predicate_passwordKdfAlgoUnknown:
+		// Removes the password
+	case algo.GetPredicateName() != mtproto.Predicate_passwordKdfAlgoModPow ||
+		algo.GetG() != int32(dh2048G[0]) || !bytes.Equal(algo.GetP(), dh2048P):
+		cp.sendRpcError(mtproto.ErrNewSettingsInvalid, msgId, salt, sessionId)
+		return
+	case len(algo.GetSalt1()) < 8 || len(algo.GetSalt2()) == 0:
+		cp.sendRpcError(mtproto.ErrNewSaltInvalid, msgId, salt, sessionId)
+		return
+	default:
+		v := new(big.Int).SetBytes(settings.GetNewPasswordHash())
+		if len(settings.GetNewPasswordHash()) > 256 || v.Sign() <= 0 || v.Cmp(gBigIntDH2048P) >= 0 {
+			cp.sendRpcError(mtproto.ErrNewSettingsInvalid, msgId, salt, sessionId)
+			return
+		}
+		password = &PasswordDoc{
+			Salt1:    algo.GetSalt1(),
+			Salt2:    algo.GetSalt2(),
+			Verifier: settings.GetNewPasswordHash(),
+		}
+	}
+
+	if password != nil {
+		if hint := settings.GetHint(); hint != nil {
+			password.Hint = hint.GetValue()
+		}
+		if email := settings.GetEmail(); email != nil {
+			if email.GetValue() != "" {
+				if _, err := mail.ParseAddress(email.GetValue()); err != nil {
+					cp.sendRpcError(mtproto.ErrEmailInvalid, msgId, salt, sessionId)
+					return
+				}
+			}
+			password.Email = email.GetValue()
+		}
+	}
+
+	if err := SetUserPassword(user.ID, password); err != nil {
+		logf(1, "[Conn %d] Failed to update password: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	logf(1, "[Conn %d] User %d updated password settings (has password: %v)\n", cp.connID, user.ID, password != nil)
+
+	cp.encodeAndSend(mtproto.MakeTLBoolTrue(nil), msgId, salt, sessionId, 64)
+}
+
+// HandleAuthCheckPassword handles TL_auth_checkPassword requests, the second
+// step of signing in to an account with a password
+func (cp *ConnProp) HandleAuthCheckPassword(obj *mtproto.TLAuthCheckPassword, msgId, salt, sessionId int64) {
+	if cp.userID != 0 {
+		user, err := FindUserByID(cp.userID)
+		if err != nil || user == nil {
+			logf(1, "[Conn %d] Failed to load user %d: %v\n", cp.connID, cp.userID, err)
+			cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+			return
+		}
+		cp.createSessionForUser(user, msgId, salt, sessionId)
+		return
+	}
+
+	authKeyID := cp.userAuthKeyID()
+	login := pendingPasswordLogin(authKeyID)
+	if login == nil {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+	user, err := FindUserByID(login.userID)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to load user %d: %v\n", cp.connID, login.userID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	if user == nil {
+		passwordLogins.Delete(authKeyID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+	if err := verifyPassword(user, obj.GetPassword()); err != nil {
+		logf(1, "[Conn %d] auth.checkPassword for user %d: %v\n", cp.connID, user.ID, err)
+		if err == mtproto.ErrPasswordHashInvalid && atomic.AddInt32(&login.attempts, 1) >= maxPasswordAttempts {
+			logf(1, "[Conn %d] Too many wrong passwords for user %d, dropping login\n", cp.connID, user.ID)
+			passwordLogins.Delete(authKeyID)
+		}
+		cp.sendRpcError(err, msgId, salt, sessionId)
+		return
+	}
+
+	passwordLogins.Delete(authKeyID)
+	logf(1, "[Conn %d] Password accepted for user %d\n", cp.connID, user.ID)
+	cp.createSessionForUser(user, msgId, salt, sessionId)
+}
+
+// expirePasswordChecks drops unused SRP exchanges, abandoned password logins
+// and password settings lockouts that are over.
+func expirePasswordChecks() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		srpChecks.Range(func(k, v interface{}) bool {
+			if now.After(v.(*srpCheck).expiresAt) {
+				srpChecks.Delete(k)
+			}
+			return true
+		})
+		passwordLogins.Range(func(k, v interface{}) bool {
+			if now.After(v.(*passwordLogin).expiresAt) {
+				passwordLogins.Delete(k)
+			}
+			return true
+		})
+		settingsFailures.Range(func(k, v interface{}) bool {
+			failures := v.(*passwordFailures)
+			failures.mu.Lock()
+			over := now.Sub(failures.first) >= passwordLockout
+			failures.mu.Unlock()
+			if over {
+				settingsFailures.Delete(k)
+			}
+			return true
+		})
+	}
+}
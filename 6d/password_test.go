@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+// testPasswordUser returns a user whose password is secret.
+func testPasswordUser(id int64, secret string) *UserDoc {
+	password := &PasswordDoc{Salt1: randomBytes(40), Salt2: randomBytes(16)}
+	password.Verifier = passwordSRP(password).GetVBytes(password.Salt1, []byte(secret))
+	return &UserDoc{ID: id, Password: password}
+}
+
+// startSRP does what account.getPassword does for user and returns the srp_id.
+func startSRP(user *UserDoc, expiresAt time.Time) (int64, []byte) {
+	srp := &srpCheck{
+		userID:    user.ID,
+		verifier:  user.Password.Verifier,
+		b:         randomBytes(256),
+		expiresAt: expiresAt,
+	}
+	srp.B = passwordSRP(user.Password).CalcSRPB2(srp.b, srp.verifier)
+	srpID := GenerateAccessHash()
+	srpChecks.Store(srpID, srp)
+	return srpID, srp.B
+}
+
+// clientCheck computes the inputCheckPasswordSRP a client sends for secret.
+func clientCheck(user *UserDoc, srpID int64, srpB []byte, secret string) *mtproto.InputCheckPasswordSRP {
+	util := passwordSRP(user.Password)
+	x := util.GetX(user.Password.Salt1, []byte(secret))
+	a, m1 := util.CalcClientM(user.Password.Salt1, x, srpB)
+	return mtproto.MakeTLInputCheckPasswordSRP(&mtproto.InputCheckPasswordSRP{
+		SrpId: srpID,
+		A:     a,
+		M1:    m1,
+	}).To_InputCheckPasswordSRP()
+}
+
+func TestVerifyPassword(t *testing.T) {
+	const secret = "correct horse"
+	empty := mtproto.MakeTLInputCheckPasswordEmpty(nil).To_InputCheckPasswordSRP()
+
+	tests := []struct {
+		name  string
+		check func(user *UserDoc) *mtproto.InputCheckPasswordSRP
+		want  error
+	}{
+		{"right password", func(user *UserDoc) *mtproto.InputCheckPasswordSRP {
+			srpID, srpB := startSRP(user, time.Now().Add(time.Minute))
+			return clientCheck(user, srpID, srpB, secret)
+		}, nil},
+		{"wrong password", func(user *UserDoc) *mtproto.InputCheckPasswordSRP {
+			srpID, srpB := startSRP(user, time.Now().Add(time.Minute))
+			return clientCheck(user, srpID, srpB, "wrong")
+		}, mtproto.ErrPasswordHashInvalid},
+		{"empty check", func(user *UserDoc) *mtproto.InputCheckPasswordSRP {
+			return empty
+		}, mtproto.ErrPasswordHashInvalid},
+		{"unknown srp_id", func(user *UserDoc) *mtproto.InputCheckPasswordSRP {
+			_, srpB := startSRP(user, time.Now().Add(time.Minute))
+			return clientCheck(user, GenerateAccessHash(), srpB, secret)
+		}, mtproto.ErrSrpIdInvalid},
+		{"expired srp_id", func(user *UserDoc) *mtproto.InputCheckPasswordSRP {
+			srpID, srpB := startSRP(user, time.Now().Add(-time.Second))
+			return clientCheck(user, srpID, srpB, secret)
+		}, mtproto.ErrSrpIdInvalid},
+		{"srp_id of another user", func(user *UserDoc) *mtproto.InputCheckPasswordSRP {
+			other := testPasswordUser(user.ID+1, secret)
+			srpID, srpB := startSRP(other, time.Now().Add(time.Minute))
+			return clientCheck(user, srpID, srpB, secret)
+		}, mtproto.ErrSrpIdInvalid},
+		{"password changed since getPassword", func(user *UserDoc) *mtproto.InputCheckPasswordSRP {
+			srpID, srpB := startSRP(user, time.Now().Add(time.Minute))
+			v, _ := srpChecks.Load(srpID)
+			v.(*srpCheck).verifier = []byte("old verifier")
+			return clientCheck(user, srpID, srpB, secret)
+		}, mtproto.ErrSrpPasswordChanged},
+	}
+	for _, tt := range tests {
+		user := testPasswordUser(1, secret)
+		if got := verifyPassword(user, tt.check(user)); got != tt.want {
+			t.Errorf("%s: verifyPassword = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyPasswordSRPUsedOnce(t *testing.T) {
+	user := testPasswordUser(1, "secret")
+	srpID, srpB := startSRP(user, time.Now().Add(time.Minute))
+	check := clientCheck(user, srpID, srpB, "secret")
+	if err := verifyPassword(user, check); err != nil {
+		t.Fatalf("first check: %v", err)
+	}
+	if err := verifyPassword(user, check); err != mtproto.ErrSrpIdInvalid {
+		t.Errorf("second check = %v, want %v", err, mtproto.ErrSrpIdInvalid)
+	}
+}
+
+func TestVerifyPasswordWithoutPassword(t *testing.T) {
+	user := &UserDoc{ID: 1}
+	tests := []struct {
+		name  string
+		check *mtproto.InputCheckPasswordSRP
+		want  error
+	}{
+		{"no check", nil, nil},
+		{"empty check", mtproto.MakeTLInputCheckPasswordEmpty(nil).To_InputCheckPasswordSRP(), nil},
+		{"srp check", mtproto.MakeTLInputCheckPasswordSRP(&mtproto.InputCheckPasswordSRP{SrpId: 1}).To_InputCheckPasswordSRP(), mtproto.ErrPasswordMissing},
+	}
+	for _, tt := range tests {
+		if got := verifyPassword(user, tt.check); got != tt.want {
+			t.Errorf("%s: verifyPassword = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPendingPasswordLogin(t *testing.T) {
+	passwordLogins.Store(int64(1), &passwordLogin{userID: 10, expiresAt: time.Now().Add(time.Minute)})
+	passwordLogins.Store(int64(2), &passwordLogin{userID: 20, expiresAt: time.Now().Add(-time.Second)})
+	defer passwordLogins.Delete(int64(1))
+
+	tests := []struct {
+		authKeyID  int64
+		wantUserID int64
+	}{
+		{1, 10},
+		{2, 0},
+		{3, 0},
+	}
+	for _, tt := range tests {
+		var got int64
+		if login := pendingPasswordLogin(tt.authKeyID); login != nil {
+			got = login.userID
+		}
+		if got != tt.wantUserID {
+			t.Errorf("pendingPasswordLogin(%d) is for user %d, want %d", tt.authKeyID, got, tt.wantUserID)
+		}
+	}
+	if _, ok := passwordLogins.Load(int64(2)); ok {
+		t.Error("expired login was not dropped")
+	}
+}
+
+func TestVerifySettingsPasswordLockout(t *testing.T) {
+	const secret = "secret"
+	user := testPasswordUser(GenerateAccessHash(), secret)
+	defer settingsFailures.Delete(user.ID)
+	check := func(password string) error {
+		srpID, srpB := startSRP(user, time.Now().Add(time.Minute))
+		return verifySettingsPassword(user, clientCheck(user, srpID, srpB, password))
+	}
+
+	for i := 0; i < maxPasswordAttempts; i++ {
+		if err := check("wrong"); err != mtproto.ErrPasswordHashInvalid {
+			t.Fatalf("wrong password %d: %v", i, err)
+		}
+	}
+	if err := check(secret); err == nil || !strings.Contains(err.Error(), "FLOOD_WAIT_") {
+		t.Fatalf("right password while locked = %v, want FLOOD_WAIT", err)
+	}
+
+	// Another user is not affected
+	other := testPasswordUser(user.ID+1, secret)
+	defer settingsFailures.Delete(other.ID)
+	srpID, srpB := startSRP(other, time.Now().Add(time.Minute))
+	if err := verifySettingsPassword(other, clientCheck(other, srpID, srpB, secret)); err != nil {
+		t.Errorf("other user: %v", err)
+	}
+
+	v, _ := settingsFailures.Load(user.ID)
+	v.(*passwordFailures).first = time.Now().Add(-passwordLockout)
+	if err := check(secret); err != nil {
+		t.Errorf("right password after the lockout: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limits, 0 disables a limit:
+//   - MAX_CONNS_PER_IP: concurrent connections per IP
+//   - MAX_HANDSHAKES_PER_MINUTE: req_pq_multi per IP, each starting an RSA
+//     decrypt and two 2048 bit modexps
+//   - MAX_UNAUTH_MESSAGES_PER_MINUTE: frames per connection while no user is
+//     logged in on it, handshake messages included. It is counted per
+//     connection so that clients sharing an IP behind NAT don't use up each
+//     other's budget; MAX_CONNS_PER_IP still bounds the total per IP.
+var (
+	maxConnsPerIP              = envLimit("MAX_CONNS_PER_IP", 64)
+	maxHandshakesPerMinute     = envLimit("MAX_HANDSHAKES_PER_MINUTE", 30)
+	maxUnauthMessagesPerMinute = envLimit("MAX_UNAUTH_MESSAGES_PER_MINUTE", 600)
+)
+
+func envLimit(name string, def int) int {
+	envVal := os.Getenv(name)
+	if envVal == "" {
+		return def
+	}
+	limit, err := strconv.Atoi(envVal)
+	if err != nil || limit < 0 {
+		log.Fatalf("Invalid %s: %q", name, envVal)
+	}
+	return limit
+}
+
+// Counters for operators, served as JSON on /debug/vars when METRICS_ADDR is
+// set.
+var (
+	rateLimitStats     = expvar.NewMap("ratelimit")
+	connsRejected      = new(expvar.Int)
+	handshakesRejected = new(expvar.Int)
+	unauthMsgsRejected = new(expvar.Int)
+	trackedIPs         = expvar.Func(func() interface{} { return ipLimits.len() })
+)
+
+func init() {
+	rateLimitStats.Set("connections_rejected", connsRejected)
+	rateLimitStats.Set("handshakes_rejected", handshakesRejected)
+	rateLimitStats.Set("unauth_messages_rejected", unauthMsgsRejected)
+	rateLimitStats.Set("tracked_ips", trackedIPs)
+}
+
+// serveMetrics exposes the expvar counters on METRICS_ADDR, if set.
+func serveMetrics() {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return
+	}
+	log.Printf("Metrics on http://%s/debug/vars", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
+
+// rateWindow counts events in fixed one minute windows.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// allow records an event and reports whether it stays within limit.
+func (w *rateWindow) allow(limit int, now time.Time) bool {
+	if limit == 0 {
+		return true
+	}
+	if now.Sub(w.start) >= time.Minute {
+		w.start = now
+		w.count = 0
+	}
+	if w.count >= limit {
+		return false
+	}
+	w.count++
+	return true
+}
+
+func (w *rateWindow) idle(now time.Time) bool {
+	return now.Sub(w.start) >= time.Minute
+}
+
+type ipUsage struct {
+	conns      int
+	handshakes rateWindow
+}
+
+// ipLimiter tracks what every remote IP is using.
+type ipLimiter struct {
+	mu  sync.Mutex
+	ips map[string]*ipUsage
+}
+
+var ipLimits = &ipLimiter{ips: make(map[string]*ipUsage)}
+
+func (l *ipLimiter) usage(ip string) *ipUsage {
+	u, ok := l.ips[ip]
+	if !ok {
+		u = &ipUsage{}
+		l.ips[ip] = u
+	}
+	return u
+}
+
+func (l *ipLimiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.ips)
+}
+
+// acquireConn counts a new connection from ip. It returns false, counting
+// nothing, if ip already has as many connections as allowed.
+func (l *ipLimiter) acquireConn(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u := l.usage(ip)
+	if maxConnsPerIP != 0 && u.conns >= maxConnsPerIP {
+		connsRejected.Add(1)
+		return false
+	}
+	u.conns++
+	return true
+}
+
+// releaseConn undoes a successful acquireConn.
+func (l *ipLimiter) releaseConn(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.usage(ip).conns--
+}
+
+func (l *ipLimiter) allowHandshake(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.usage(ip).handshakes.allow(maxHandshakesPerMinute, time.Now()) {
+		handshakesRejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// allowUnauthMessage counts a frame received while no user is logged in on
+// the connection. Only the connection's own goroutine calls it.
+func (cp *ConnProp) allowUnauthMessage() bool {
+	if !cp.unauthMessages.allow(maxUnauthMessagesPerMinute, time.Now()) {
+		unauthMsgsRejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// expireIPUsage forgets IPs without connections whose windows are over.
+func expireIPUsage() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		ipLimits.mu.Lock()
+		for ip, u := range ipLimits.ips {
+			if u.conns <= 0 && u.handshakes.idle(now) {
+				delete(ipLimits.ips, ip)
+			}
+		}
+		ipLimits.mu.Unlock()
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateWindow(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		limit int
+		at    []time.Duration // Offsets from start of each event
+		want  []bool
+	}{
+		{"within the limit", 3, []time.Duration{0, time.Second, 2 * time.Second}, []bool{true, true, true}},
+		{"over the limit", 2, []time.Duration{0, time.Second, 2 * time.Second}, []bool{true, true, false}},
+		{"refilled after a minute", 2, []time.Duration{0, time.Second, 2 * time.Second, time.Minute}, []bool{true, true, false, true}},
+		{"blocked until the window ends", 1, []time.Duration{0, 30 * time.Second, 59 * time.Second, 61 * time.Second}, []bool{true, false, false, true}},
+		{"disabled", 0, []time.Duration{0, 0, 0}, []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		var w rateWindow
+		for i, at := range tt.at {
+			if got := w.allow(tt.limit, start.Add(at)); got != tt.want[i] {
+				t.Errorf("%s: event %d allowed = %v, want %v", tt.name, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestAcquireConn(t *testing.T) {
+	defer func(limit int) { maxConnsPerIP = limit }(maxConnsPerIP)
+	maxConnsPerIP = 2
+	l := &ipLimiter{ips: make(map[string]*ipUsage)}
+
+	steps := []struct {
+		acquire bool // Else release
+		ip      string
+		want    bool
+	}{
+		{true, "10.0.0.1", true},
+		{true, "10.0.0.1", true},
+		{true, "10.0.0.1", false},
+		{true, "10.0.0.2", true},
+		{false, "10.0.0.1", true},
+		{true, "10.0.0.1", true},
+		{true, "10.0.0.1", false},
+	}
+	for i, s := range steps {
+		if !s.acquire {
+			l.releaseConn(s.ip)
+			continue
+		}
+		if got := l.acquireConn(s.ip); got != s.want {
+			t.Errorf("step %d: acquireConn(%s) = %v, want %v", i, s.ip, got, s.want)
+		}
+	}
+}
+
+func TestUnauthMessagesPerConnection(t *testing.T) {
+	defer func(limit int) { maxUnauthMessagesPerMinute = limit }(maxUnauthMessagesPerMinute)
+	maxUnauthMessagesPerMinute = 3
+
+	// Two clients behind the same NAT
+	first := &ConnProp{connID: 1, ip: "10.0.0.1"}
+	second := &ConnProp{connID: 2, ip: "10.0.0.1"}
+	for i := 0; i < 3; i++ {
+		if !first.allowUnauthMessage() {
+			t.Fatalf("message %d of the first connection rejected", i)
+		}
+	}
+	if first.allowUnauthMessage() {
+		t.Error("first connection went over its limit")
+	}
+	if !second.allowUnauthMessage() {
+		t.Error("second connection on the same IP was limited by the first")
+	}
+}
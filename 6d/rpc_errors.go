@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/teamgram/proto/mtproto"
+)
+
+// sendRpcError answers the request msgId with an rpc_error. err should be one
+// of the mtproto.Err* errors (PHONE_CODE_INVALID, AUTH_KEY_UNREGISTERED,
+// PEER_ID_INVALID, ...) or built with mtproto.NewErrFloodWaitX; any other
+// error reaches the client as 500 INTERNAL_SERVER_ERROR.
+func (cp *ConnProp) sendRpcError(err error, msgId, salt, sessionId int64) {
+	rpcErr := mtproto.NewRpcError(err)
+	if rpcErr == nil {
+		rpcErr = mtproto.NewRpcError(mtproto.ErrInternalServerError)
+	}
+	logf(1, "[Conn %d] rpc_error %d %s for msg %d\n", cp.connID, rpcErr.Code(), rpcErr.Message(), msgId)
+	cp.encodeAndSend(rpcErr, msgId, salt, sessionId, 128)
+}
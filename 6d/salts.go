@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+const (
+	serverSaltPeriod  = time.Hour        // A new salt starts every period
+	serverSaltOverlap = 30 * time.Minute // Consecutive salts overlap by this much
+	futureSaltsAhead  = 64               // Salts kept issued ahead (get_future_salts returns at most this many)
+)
+
+// saltManager issues and checks the server salts of one auth key. Salts start
+// every serverSaltPeriod and stay valid for serverSaltPeriod+serverSaltOverlap,
+// so a client switching to the next salt a little late is still accepted.
+// The list is persisted in the server_salts collection.
+type saltManager struct {
+	mu        sync.Mutex
+	authKeyID int64
+	salts     []ServerSaltDoc // Ordered by ValidSince
+}
+
+var saltManagers sync.Map // authKeyID -> *saltManager
+
+// getSaltManager returns the salt manager of authKeyID, loading its salts
+// from the database on first use.
+func getSaltManager(authKeyID int64) *saltManager {
+	if v, ok := saltManagers.Load(authKeyID); ok {
+		return v.(*saltManager)
+	}
+
+	m := &saltManager{authKeyID: authKeyID}
+	if salts, err := LoadServerSalts(authKeyID); err != nil {
+		logf(1, "Failed to load server salts for auth key %d: %v\n", authKeyID, err)
+	} else {
+		m.salts = salts
+	}
+
+	v, _ := saltManagers.LoadOrStore(authKeyID, m)
+	return v.(*saltManager)
+}
+
+// setInitialServerSalt makes the salt agreed on during the DH exchange
+// (new_nonce[0:8] xor server_nonce[0:8]) the first salt of a new auth key.
+func setInitialServerSalt(authKeyID, salt int64) {
+	now := time.Now()
+	m := &saltManager{
+		authKeyID: authKeyID,
+		salts: []ServerSaltDoc{{
+			Salt:       salt,
+			ValidSince: now,
+			ValidUntil: now.Add(serverSaltPeriod + serverSaltOverlap),
+		}},
+	}
+	m.mu.Lock()
+	m.refill(now, futureSaltsAhead)
+	m.mu.Unlock()
+	saltManagers.Store(authKeyID, m)
+}
+
+// refill drops expired salts and issues new ones until n salts starting at
+// or after the current one exist, persisting the list if it changed.
+// Callers hold m.mu.
+func (m *saltManager) refill(now time.Time, n int) {
+	changed := false
+
+	live := m.salts[:0]
+	for _, s := range m.salts {
+		if now.Before(s.ValidUntil) {
+			live = append(live, s)
+		} else {
+			changed = true
+		}
+	}
+	m.salts = live
+
+	for len(m.salts) < n {
+		since := now
+		if len(m.salts) > 0 {
+			since = m.salts[len(m.salts)-1].ValidSince.Add(serverSaltPeriod)
+		}
+		m.salts = append(m.salts, ServerSaltDoc{
+			Salt:       randomSalt(),
+			ValidSince: since,
+			ValidUntil: since.Add(serverSaltPeriod + serverSaltOverlap),
+		})
+		changed = true
+	}
+
+	if changed {
+		if err := SaveServerSalts(m.authKeyID, m.salts); err != nil {
+			logf(1, "Failed to save server salts for auth key %d: %v\n", m.authKeyID, err)
+		}
+	}
+}
+
+// current returns the newest salt that is already valid. Callers hold m.mu.
+func (m *saltManager) current(now time.Time) int64 {
+	var salt int64
+	for _, s := range m.salts {
+		if now.Before(s.ValidSince) {
+			break
+		}
+		salt = s.Salt
+	}
+	return salt
+}
+
+// Current returns the salt clients of this auth key should use now.
+func (m *saltManager) Current() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.refill(now, futureSaltsAhead)
+	return m.current(now)
+}
+
+// Valid reports whether salt is valid right now. Expired salts and salts
+// whose validity has not started yet are rejected; the latter get the same
+// clock skew allowance as msg_id.
+func (m *saltManager) Valid(salt int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, s := range m.salts {
+		if s.Salt == salt {
+			return !now.Add(msgIdMaxFuture*time.Second).Before(s.ValidSince) && now.Before(s.ValidUntil)
+		}
+	}
+	return false
+}
+
+// Future returns up to num salts starting with the current one.
+func (m *saltManager) Future(num int) []ServerSaltDoc {
+	if num < 1 {
+		num = 1
+	}
+	if num > futureSaltsAhead {
+		num = futureSaltsAhead
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.refill(now, futureSaltsAhead)
+
+	// Skip salts that are still valid but already superseded
+	start := 0
+	for i, s := range m.salts {
+		if now.Before(s.ValidSince) {
+			break
+		}
+		start = i
+	}
+	salts := m.salts[start:]
+	if len(salts) > num {
+		salts = salts[:num]
+	}
+	return append([]ServerSaltDoc(nil), salts...)
+}
+
+// currentServerSalt returns the salt the client of authKeyID should use.
+func currentServerSalt(authKeyID int64) int64 {
+	return getSaltManager(authKeyID).Current()
+}
+
+// validServerSalt reports whether a client message of authKeyID may carry salt.
+func validServerSalt(authKeyID, salt int64) bool {
+	return getSaltManager(authKeyID).Valid(salt)
+}
+
+func randomSalt() int64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// HandleGetFutureSalts answers get_future_salts. future_salts carries the
+// request's msg_id itself and is not wrapped in rpc_result.
+func (cp *ConnProp) HandleGetFutureSalts(obj *mtproto.TLGetFutureSalts, msgId, salt, sessionId int64) {
+	salts := getSaltManager(cp.authKey.AuthKeyId()).Future(int(obj.GetNum()))
+	logf(1, "[Conn %d] get_future_salts num=%d, returning %d\n", cp.connID, obj.GetNum(), len(salts))
+
+	result := &mtproto.TLFutureSalts{
+		Data2: &mtproto.FutureSalts{
+			PredicateName: "future_salts",
+			Constructor:   -1370486635,
+			ReqMsgId:      msgId,
+			Now:           int32(time.Now().Unix()),
+		},
+	}
+	for _, s := range salts {
+		result.Data2.Salts = append(result.Data2.Salts, &mtproto.TLFutureSalt{
+			Data2: &mtproto.FutureSalt{
+				PredicateName: "future_salt",
+				Constructor:   155834844,
+				ValidSince:    int32(s.ValidSince.Unix()),
+				ValidUntil:    int32(s.ValidUntil.Unix()),
+				Salt:          s.Salt,
+			},
+		})
+	}
+
+	buf := mtproto.NewEncodeBuf(32 + 16*len(salts))
+	if err := result.Encode(buf, cp.encodeLayer()); err != nil {
+		logf(1, "[Conn %d] Failed to encode future_salts: %v\n", cp.connID, err)
+		return
+	}
+	cp.send(buf.GetBuf(), salt, sessionId)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testSaltManager returns a manager with a full set of salts, the current one
+// valid since almost an hour ago, so nothing needs to be issued or saved.
+func testSaltManager(now time.Time) *saltManager {
+	m := &saltManager{authKeyID: 1}
+	since := now.Add(-serverSaltPeriod + 20*time.Second)
+	for i := 0; i < futureSaltsAhead; i++ {
+		m.salts = append(m.salts, ServerSaltDoc{
+			Salt:       int64(100 + i),
+			ValidSince: since,
+			ValidUntil: since.Add(serverSaltPeriod + serverSaltOverlap),
+		})
+		since = since.Add(serverSaltPeriod)
+	}
+	return m
+}
+
+func TestSaltManagerCurrent(t *testing.T) {
+	now := time.Now()
+	m := testSaltManager(now)
+	tests := []struct {
+		name string
+		at   time.Time
+		want int64
+	}{
+		{"now", now, 100},
+		{"next period", now.Add(2 * time.Minute), 101},
+		{"two periods ahead", now.Add(serverSaltPeriod + 2*time.Minute), 102},
+		{"before the first salt", now.Add(-2 * serverSaltPeriod), 0},
+	}
+	for _, tt := range tests {
+		if got := m.current(tt.at); got != tt.want {
+			t.Errorf("%s: current = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSaltManagerValid(t *testing.T) {
+	now := time.Now()
+	m := testSaltManager(now)
+	// A salt that ended a minute ago
+	m.salts = append([]ServerSaltDoc{{
+		Salt:       99,
+		ValidSince: now.Add(-3 * serverSaltPeriod),
+		ValidUntil: now.Add(-time.Minute),
+	}}, m.salts...)
+
+	tests := []struct {
+		name string
+		salt int64
+		want bool
+	}{
+		{"current", 100, true},
+		{"starts within the clock skew allowance", 101, true},
+		{"starts in an hour", 102, false},
+		{"expired", 99, false},
+		{"unknown", 12345, false},
+	}
+	for _, tt := range tests {
+		if got := m.Valid(tt.salt); got != tt.want {
+			t.Errorf("%s: Valid(%d) = %v, want %v", tt.name, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestSaltManagerFuture(t *testing.T) {
+	m := testSaltManager(time.Now())
+	tests := []struct {
+		num       int
+		wantCount int
+	}{
+		{0, 1},
+		{1, 1},
+		{5, 5},
+		{futureSaltsAhead, futureSaltsAhead},
+		{futureSaltsAhead + 10, futureSaltsAhead},
+	}
+	for _, tt := range tests {
+		salts := m.Future(tt.num)
+		if len(salts) != tt.wantCount {
+			t.Errorf("Future(%d) returned %d salts, want %d", tt.num, len(salts), tt.wantCount)
+			continue
+		}
+		if salts[0].Salt != 100 {
+			t.Errorf("Future(%d) starts with %d, want the current salt 100", tt.num, salts[0].Salt)
+		}
+		for i := 1; i < len(salts); i++ {
+			if !salts[i].ValidSince.After(salts[i-1].ValidSince) {
+				t.Errorf("Future(%d): salt %d does not start after salt %d", tt.num, i, i-1)
+			}
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -18,12 +20,41 @@ import (
 )
 
 type ConnProp struct {
-	conn           net.Conn
-	aesCtr         *AesCTR128Crypto
-	ctrInitialized bool
-	connID         int
-	authKey        *crypto.AuthKey
-	userID         int64 // User ID if authenticated
+	conn      net.Conn
+	aesCtr    *AesCTR128Crypto // nil for non-obfuscated transports
+	transport *transport
+	dcID      int16 // DC id requested in the obfuscated init header
+	connID    int
+	ip        string // Remote address without port, key of the per-IP limits
+	authKey   *crypto.AuthKey
+	keyInfo   *authKeyInfo // Temp/bound state of authKey
+	userID    int64        // User ID if authenticated
+
+	// authKey, keyInfo and userID are only written by the connection's own
+	// goroutine, under mu; other goroutines read them through identity and
+	// currentAuthKey.
+	// loggedOut is how logOutAuthKey tells the connection to drop userID.
+	loggedOut bool // guarded by mu
+
+	hs *handshake // DH handshake in progress, nil if none
+
+	unauthMessages rateWindow // Frames received while no user is logged in
+
+	closeAfterFlush bool // Close the connection once the current batch is written
+
+	mu        sync.Mutex // Guards sessionID, salt and the writes of authKey, keyInfo and userID
+	sessionID int64      // Last session_id the client used on this connection
+	salt      int64      // Last server salt the client used on this connection
+
+	withoutUpdates bool  // Last query came with invokeWithoutUpdates (guarded by mu)
+	layer          int32 // API layer from invokeWithLayer, 0 until known (guarded by mu)
+
+	writeMu sync.Mutex // Serializes framing, CTR encryption and writes to conn
+
+	outMu       sync.Mutex      // Guards the fields below
+	batching    bool            // Outgoing messages are queued until flush
+	outQueue    []queuedMessage // Messages of the current batch
+	pendingAcks []int64         // Client msg_ids to acknowledge with the next flush
 }
 
 var (
@@ -42,229 +73,270 @@ func handleConnection(conn net.Conn) {
 	connMutex.Unlock()
 
 	cp := &ConnProp{conn: conn, connID: connID}
+	cp.ip = cp.clientIP()
+
+	logf(1, "[Conn %d] New connection from %s\n", connID, conn.RemoteAddr())
+
+	allowed := ipLimits.acquireConn(cp.ip)
+	if allowed {
+		defer ipLimits.releaseConn(cp.ip)
+	} else {
+		// -429 can only be framed once the transport is known, so give the
+		// client a moment to send its header
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	tr, err := cp.detectTransport(bufio.NewReaderSize(conn, 64*1024))
+	if err != nil {
+		logf(1, "[Conn %d] Transport detection failed: %v\n", connID, err)
+		return
+	}
+	cp.transport = tr
+	if !allowed {
+		logf(1, "[Conn %d] Too many connections from %s\n", connID, cp.ip)
+		cp.sendTransportError(transportErrFlood)
+		return
+	}
+	logf(1, "[Conn %d] Transport: %s (obfuscated: %v)\n", connID, transportName(tr.tag), cp.aesCtr != nil)
 
 	// Track active connection
 	activeConnections.Store(connID, cp)
 	defer activeConnections.Delete(connID)
 
-	logf(1, "[Conn %d] New connection from %s\n", connID, conn.RemoteAddr())
-
-	var nonce, serverNonce, newNonce, a []byte
-	buffer := make([]byte, 5000)
-
 	for {
-		n, err := conn.Read(buffer)
-		if n == 0 {
-			logf(1, "[Conn %d] Connection closed\n", connID)
-			break
-		}
-		logf(1, "[Conn %d] Read %d bytes\n", connID, n)
+		payload, err := tr.readFrame()
 		if err != nil {
-			logf(1, "[Conn %d] Read error: %v\n", connID, err)
+			if err == io.EOF {
+				logf(1, "[Conn %d] Connection closed\n", connID)
+			} else {
+				logf(1, "[Conn %d] Read error: %v\n", connID, err)
+			}
+			break
 		}
+		logf(2, "[Conn %d] Read frame of %d bytes\n", connID, len(payload))
 
-		if !cp.ctrInitialized {
-			cp.aesCtr = initializeCTRCodec(buffer, n)
-			cp.ctrInitialized = true
+		if cp.userID == 0 && !cp.allowUnauthMessage() {
+			logf(1, "[Conn %d] Too many unauthenticated messages from %s\n", connID, cp.ip)
+			cp.sendTransportError(transportErrFlood)
+			return
 		}
 
-		decrypted := cp.aesCtr.Decrypt(buffer[:n])
-
-		// Try to discover auth key from the data if we don't have one
-		if cp.authKey == nil {
-			authKey, offset, _ := FindAuthKeyInData(decrypted)
-			if authKey != nil {
-				authKeyID := authKey.AuthKeyId()
-				cp.authKey = authKey
-
-				logf(1, "[Conn %d] Auth key discovered from data at offset %d: %d (now serving this session)\n",
-					cp.connID, offset, authKeyID)
-
-				// Try to load session to get user ID
-				session, err := FindSessionByAuthKey(authKeyID)
-				if err == nil && session != nil && session.UserID != 0 {
-					oldUserID := cp.userID
-					cp.userID = session.UserID
-					if oldUserID != 0 && oldUserID != cp.userID {
-						logf(1, "[Conn %d] WARNING: UserID changed from %d to %d on same connection!\n",
-							cp.connID, oldUserID, cp.userID)
-					}
-					logf(1, "[Conn %d] Session loaded, authKey=%d → userID=%d\n", cp.connID, authKeyID, cp.userID)
-				} else {
-					logf(1, "[Conn %d] No session found for authKey=%d (err=%v)\n", cp.connID, authKeyID, err)
-				}
+		// Every message starts with its auth_key_id, 0 for the unencrypted
+		// messages of the DH handshake
+		if len(payload) < 8 {
+			logf(1, "[Conn %d] Frame too short: %d bytes\n", connID, len(payload))
+			continue
+		}
+		authKeyID := int64(binary.LittleEndian.Uint64(payload[:8]))
+		if authKeyID == 0 {
+			if err := cp.handleHandshake(payload); err != nil {
+				logf(1, "[Conn %d] Handshake failed, closing connection: %v\n", connID, err)
+				return
 			}
+			continue
 		}
 
-		if cp.authKey != nil && cp.hasAuthKeyId(decrypted) {
-			cp.handleAuthenticated(decrypted)
-		} else {
-			cp.handleHandshake(decrypted, &nonce, &serverNonce, &newNonce, &a)
+		if cp.authKey == nil || cp.authKey.AuthKeyId() != authKeyID || cp.keyInfo.expired(time.Now()) {
+			if !cp.useAuthKey(authKeyID) {
+				return
+			}
+		}
+		cp.beginBatch()
+		err = cp.handleAuthenticated(payload)
+		cp.flush()
+		if err != nil {
+			logf(1, "[Conn %d] Rejected message, closing connection: %v\n", connID, err)
+			return
+		}
+		if cp.closeAfterFlush {
+			logf(1, "[Conn %d] Closing connection\n", connID)
+			return
 		}
 	}
 }
 
-func (cp *ConnProp) handleHandshake(decrypted []byte, nonce, serverNonce, newNonce, a *[]byte) {
-	for _, offset := range []int{32, 50, 64, 73} {
-		if offset >= len(decrypted) { continue }
-
-		if _, obj, _ := parseFromIncomingMessage(decrypted[offset:]); obj != nil {
-			logf(1, "[Conn %d] Handshake: %T at offset %d\n", cp.connID, obj, offset)
-			switch obj.(type) {
-				case *mtproto.TLReqPqMulti: cp.conn.Write(cp.encode(handleReqPqMulti(obj)))
-				case *mtproto.TLReq_DHParams: *nonce, *serverNonce, *newNonce, *a, _ = handleReqDHParams(cp, obj)
-				case *mtproto.TLSetClient_DHParams: handleSetClientDHParams(cp, obj, *nonce, *serverNonce, *newNonce, *a)
-			}
-			break
+// useAuthKey switches the connection to authKeyID and loads the user logged
+// in with it. Unknown keys get the AUTH_KEY_UNREGISTERED transport error so
+// the client generates a new one; false means the connection must be closed.
+func (cp *ConnProp) useAuthKey(authKeyID int64) bool {
+	info, err := lookupAuthKey(authKeyID)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to look up auth key %d: %v\n", cp.connID, authKeyID, err)
+		return false
+	}
+	if info == nil {
+		logf(1, "[Conn %d] Unknown or expired auth key %d\n", cp.connID, authKeyID)
+		cp.sendTransportError(transportErrAuthKeyNotFound)
+		return false
+	}
+	cp.setAuthKey(info, 0)
+
+	// Try to load session to get user ID. A bound temp key acts for the
+	// permanent key's session.
+	session, err := FindSessionByAuthKey(cp.userAuthKeyID())
+	if err == nil && session != nil && session.UserID != 0 {
+		cp.setUserID(session.UserID)
+		logf(1, "[Conn %d] Session loaded, authKey=%d → userID=%d\n", cp.connID, authKeyID, cp.userID)
+		// Until this connection sends invokeWithLayer, answer in
+		// the layer the client used last time
+		if supportedLayer(session.Layer) {
+			cp.mu.Lock()
+			cp.layer = session.Layer
+			cp.mu.Unlock()
 		}
+	} else {
+		logf(1, "[Conn %d] No session found for authKey=%d (err=%v)\n", cp.connID, authKeyID, err)
 	}
+	return true
 }
 
-func (cp *ConnProp) handleAuthenticated(decrypted []byte) {
-	if len(decrypted) < 24 { return } // Need at least auth_key_id(8) + msg_key(16)
+// setAuthKey switches the connection to info's key, logged in as userID
+func (cp *ConnProp) setAuthKey(info *authKeyInfo, userID int64) {
+	cp.mu.Lock()
+	cp.authKey, cp.keyInfo = info.key, info
+	cp.userID, cp.loggedOut = userID, false
+	cp.mu.Unlock()
+}
 
-	logf(2, "[Conn %d] handleAuthenticated: buffer size %d bytes\n", cp.connID, len(decrypted))
+// currentAuthKey returns the connection's auth key, nil before it has one.
+// Paths the update dispatcher reaches use it instead of reading cp.authKey.
+func (cp *ConnProp) currentAuthKey() *crypto.AuthKey {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.authKey
+}
 
-	// Find all auth_key_id positions and process messages there
-	target := cp.authKey.AuthKeyId()
-	offset := 0
+// setUserID logs the connection in as userID, or out if it is 0
+func (cp *ConnProp) setUserID(userID int64) {
+	cp.mu.Lock()
+	cp.userID, cp.loggedOut = userID, false
+	cp.mu.Unlock()
+}
 
-	for offset <= len(decrypted)-24 {
-		// Look for auth_key_id
-		if int64(binary.LittleEndian.Uint64(decrypted[offset:offset+8])) == target {
-			logf(2, "[Conn %d] Found auth_key_id at offset %d\n", cp.connID, offset)
+// identity returns the user and the auth key the connection acts for. It is
+// for goroutines other than the connection's own; authKeyID is 0 until the
+// connection has a key.
+func (cp *ConnProp) identity() (userID, authKeyID int64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.authKey == nil {
+		return 0, 0
+	}
+	if !cp.loggedOut {
+		userID = cp.userID
+	}
+	return userID, cp.userAuthKeyID()
+}
 
-			// Try to decrypt message at this position
-			msgLen := cp.aesIgeDecrypt(decrypted, offset)
-			if msgLen > 0 {
-				logf(2, "[Conn %d] Processed message at offset %d, length %d\n", cp.connID, offset, msgLen)
-				offset += msgLen // Skip to after this message
-			} else {
-				offset++ // Auth key ID matched but decrypt failed, continue searching
-			}
-		} else {
-			offset++
-		}
+// applyLogOut drops userID if logOutAuthKey logged the connection out since
+// the last message.
+func (cp *ConnProp) applyLogOut() {
+	cp.mu.Lock()
+	if cp.loggedOut {
+		cp.userID, cp.loggedOut = 0, false
 	}
+	cp.mu.Unlock()
 }
 
-func (cp *ConnProp) aesIgeDecrypt(decrypted []byte, offset int) int {
-	// offset points to auth_key_id, skip it to get to msg_key
+// handleAuthenticated processes one encrypted message. An error means the
+// message was forged, replayed or malformed and the connection must be closed.
+func (cp *ConnProp) handleAuthenticated(payload []byte) error {
+	logf(2, "[Conn %d] handleAuthenticated: buffer size %d bytes\n", cp.connID, len(payload))
+
 	// Format: [auth_key_id:8][msg_key:16][encrypted_data]
-	if offset+24 >= len(decrypted) {
-		logf(2, "[Conn %d] aesIgeDecrypt: offset %d too close to end (%d bytes)\n", cp.connID, offset, len(decrypted))
-		return 0
+	rawP, err := decryptMessage(cp.authKey, payload)
+	if err != nil {
+		return err
 	}
 
-	msgKeyOffset := offset + 8
-	remainingBytes := len(decrypted) - msgKeyOffset - 16
-
-	// Try to find the correct encrypted data length by trying multiples of 16
-	var rawP []byte
-	var err error
-	validEncLen := 0
-
-	minLen := 48  // Minimum: 32 bytes header + 16 bytes minimum body
-	maxLen := (remainingBytes / 16) * 16
-
-	for encLen := minLen; encLen <= maxLen; encLen += 16 {
-		rawP, err = cp.authKey.AesIgeDecrypt(decrypted[msgKeyOffset:msgKeyOffset+16], decrypted[msgKeyOffset+16:msgKeyOffset+16+encLen])
-		if err == nil && len(rawP) >= 32 {
-			msg := &mtproto.TLMessage2{}
-			msg.Decode(mtproto.NewDecodeBuf(rawP[16:]))
-			if msg.Object != nil {
-				validEncLen = encLen
-				logf(2, "[Conn %d] Found message at offset %d (encrypted: %d bytes)\n", cp.connID, offset, encLen)
-				break
-			}
-		}
-	}
+	salt := int64(binary.LittleEndian.Uint64(rawP[0:8]))
+	sessionId := int64(binary.LittleEndian.Uint64(rawP[8:16]))
+	msgId := int64(binary.LittleEndian.Uint64(rawP[16:24]))
 
-	if validEncLen == 0 {
-		return 0
+	if getSessionState(cp.authKey.AuthKeyId(), sessionId).replayed(msgId) {
+		return fmt.Errorf("replayed msg_id %d in session %d", msgId, sessionId)
 	}
 
 	msg := &mtproto.TLMessage2{}
 	msg.Decode(mtproto.NewDecodeBuf(rawP[16:]))
 
-	salt := int64(binary.LittleEndian.Uint64(rawP[0:8]))
-	sessionId := int64(binary.LittleEndian.Uint64(rawP[8:16]))
-	msgId := int64(binary.LittleEndian.Uint64(rawP[16:24]))
+	logf(1, "[Conn %d] Message: %T, msgId: %d\n", cp.connID, msg.Object, msgId)
 
-	logf(1, "[Conn %d] Message: %T at offset %d, msgId: %d\n", cp.connID, msg.Object, offset, msgId)
+	if !cp.checkServiceLayer(msgId, msg.Seqno, salt, sessionId) {
+		return nil
+	}
 
-	// Update session in database on every message
-	go func() {
-		session := &SessionDoc{
-			SessionID:  sessionId,
-			AuthKeyID:  cp.authKey.AuthKeyId(),
-			UserID:     cp.userID, // Will be 0 if not authenticated
-			Salt:       salt,
-			LastUsedAt: time.Now(),
-		}
-		UpdateSession(session)
-	}()
+	if msg.Seqno&1 == 1 {
+		cp.queueAck(msgId)
+	}
+	if getSessionState(cp.authKey.AuthKeyId(), sessionId).claimNewSession() {
+		cp.sendNewSessionCreated(msgId, sessionId)
+	}
 
-	cp.replyMsg(msg.Object, msgId, salt, sessionId)
+	cp.mu.Lock()
+	newSession := cp.sessionID != sessionId
+	cp.sessionID, cp.salt = sessionId, salt
+	cp.mu.Unlock()
 
-	// Return the total message length (auth_key_id + msg_key + encrypted data)
-	return 8 + 16 + validEncLen
-}
+	// First message of this session on this connection: deliver whatever the
+	// client missed while it was disconnected
+	if newSession {
+		cp.resendPending(salt, sessionId)
+	}
 
-func (cp *ConnProp) encode(obj mtproto.TLObject) []byte {
-	x := mtproto.NewEncodeBuf(512)
-	serializeToBuffer(x, mtproto.GenerateMessageId(), obj)
-	return cp.encodeCtr(x.GetBuf())
-}
+	// Update session in database on every message. The user binding is left
+	// to sign in and log out.
+	cp.applyLogOut()
+	session := &SessionDoc{
+		SessionID:  sessionId,
+		AuthKeyID:  cp.userAuthKeyID(),
+		Salt:       salt,
+		LastUsedAt: time.Now(),
+	}
+	go UpdateSession(session)
 
-func (cp *ConnProp) encodeCtr(data []byte) []byte {
-	size := len(data) / 4
-	sb := []byte{byte(size)}
-	if size >= 127 {
-		sb = make([]byte, 4)
-		binary.LittleEndian.PutUint32(sb, uint32(size<<8|127))
+	if msg.Object == nil {
+		logf(1, "[Conn %d] Undecodable message %d\n", cp.connID, msgId)
+		return nil
 	}
-	return cp.aesCtr.Encrypt(append(sb, data...))
+	cp.dispatch(msg.Object, msgId, salt, sessionId)
+	return nil
 }
 
-func trimToActualData(data []byte) []byte {
-	// Find the last non-zero byte
-	lastNonZero := len(data) - 1
-	for lastNonZero >= 0 && data[lastNonZero] == 0 {
-		lastNonZero--
-	}
-	// Return up to the last non-zero byte (plus 1 for length)
-	if lastNonZero < len(data)-1 {
-		return data[:lastNonZero+1]
+// writeFrame frames data for the connection's transport, obfuscates it if
+// needed and writes it out. Safe for concurrent use.
+func (cp *ConnProp) writeFrame(data []byte) {
+	cp.writeMu.Lock()
+	defer cp.writeMu.Unlock()
+
+	frame := cp.transport.encodeFrame(data)
+	if cp.aesCtr != nil {
+		frame = cp.aesCtr.Encrypt(frame)
 	}
-	return data
+	cp.conn.Write(frame)
 }
 
 func (cp *ConnProp) send(body []byte, salt, sessionId int64) {
-	if cp.authKey == nil { return }
+	authKey := cp.currentAuthKey()
+	if authKey == nil { return }
+	body = packRpcResult(body)
+	msgId, seqNo := getSessionState(authKey.AuthKeyId(), sessionId).nextOutgoing(body)
+	cp.enqueue(msgId, seqNo, body, salt, sessionId)
+}
+
+// sendMessage encrypts body as the server message msgId/seqNo and writes it.
+func (cp *ConnProp) sendMessage(msgId int64, seqNo int32, body []byte, salt, sessionId int64) {
 	x := mtproto.NewEncodeBuf(512)
-	x.Long(salt); x.Long(sessionId); x.Long(mtproto.GenerateMessageId())
-	x.Int(1); x.Int(int32(len(body))); x.Bytes(body)
-	msgKey, data, _ := cp.authKey.AesIgeEncrypt(x.GetBuf())
+	x.Long(salt); x.Long(sessionId); x.Long(msgId)
+	x.Int(seqNo); x.Int(int32(len(body))); x.Bytes(body)
+	authKey := cp.currentAuthKey()
+	msgKey, data, _ := authKey.AesIgeEncrypt(x.GetBuf())
 	x2 := mtproto.NewEncodeBuf(8 + len(msgKey) + len(data))
-	x2.Long(cp.authKey.AuthKeyId()); x2.Bytes(msgKey); x2.Bytes(data)
-	finalData := trimToActualData(x2.GetBuf())
-	cp.conn.Write(cp.encodeCtr(finalData))
+	x2.Long(authKey.AuthKeyId()); x2.Bytes(msgKey); x2.Bytes(data)
+	cp.writeFrame(x2.GetBuf())
 }
 
 
-func (cp *ConnProp) hasAuthKeyId(data []byte) bool {
-	if cp.authKey == nil || len(data) < 8 { return false }
-	target := cp.authKey.AuthKeyId()
-	for i := 0; i <= len(data)-8; i++ {
-		if int64(binary.LittleEndian.Uint64(data[i:i+8])) == target {
-			logf(1, "[Conn %d] AuthKeyId found at offset %d\n", cp.connID, i)
-			return true
-		}
-	}
-	return false
-}
-
 var DEBUG_LVL = func() int {
 	if envVal := os.Getenv("DEBUG_LVL"); envVal != "" {
 		if level, err := strconv.Atoi(envVal); err == nil {
@@ -294,6 +366,17 @@ func main() {
 	}
 	defer CloseMongoDB()
 
+	if err := loadRSAKeys(); err != nil {
+		log.Fatalf("Failed to load RSA keys: %v", err)
+	}
+
+	go expireSessionStates()
+	go purgeExpiredAuthKeys()
+	go expireIPUsage()
+	go expirePasswordChecks()
+	go expireLoginTokens()
+	serveMetrics()
+
 	listener, err := net.Listen("tcp", ":10443")
 	if err != nil {
 		log.Fatalf("Failed to start listener: %v", err)
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+// bad_msg_notification error codes
+const (
+	badMsgIdTooLow     = 16 // msg_id too low (client time behind server)
+	badMsgIdTooHigh    = 17 // msg_id too high (client time ahead of server)
+	badMsgIdParity     = 18 // the two lower bits of msg_id must be zero
+	badMsgSeqnoTooLow  = 32 // seqno lower than that of an older message
+	badMsgSeqnoTooHigh = 33 // seqno higher than that of a newer message
+	badMsgServerSalt   = 48 // sent as bad_server_salt with the salt to use
+)
+
+const (
+	msgIdMaxPast      = 300 // Seconds a client msg_id may lag behind server time
+	msgIdMaxFuture    = 30  // Seconds a client msg_id may run ahead of server time
+	sessionIdleExpiry = 24 * time.Hour
+)
+
+// sessionState is the server side of one MTProto session (auth key plus
+// client-chosen session_id). It lives in memory and survives reconnects.
+type sessionState struct {
+	mu sync.Mutex
+
+	authKeyID int64
+	sessionID int64
+
+	lastMsgID int64 // Highest client msg_id accepted so far
+	lastSeqNo int32 // seqno of the message with lastMsgID
+
+	outMsgID   int64 // Last msg_id used by the server in this session
+	outContent int32 // Number of content-related messages sent (for seqno)
+
+	outbox   map[int64]*outboundMessage // Content-related server messages awaiting msgs_ack
+	received receivedLog                // Recently accepted client messages
+	parked   []*parkedQuery             // invokeAfterMsg queries waiting for their dependencies
+
+	announced bool  // new_session_created was sent
+	layer     int32 // API layer negotiated with invokeWithLayer, 0 if unknown
+
+	lastActive time.Time
+}
+
+type sessionKey struct {
+	authKeyID int64
+	sessionID int64
+}
+
+var sessionStates sync.Map // sessionKey -> *sessionState
+
+// getSessionState returns the state of (authKeyID, sessionID), creating it on
+// first use.
+func getSessionState(authKeyID, sessionID int64) *sessionState {
+	key := sessionKey{authKeyID, sessionID}
+	if v, ok := sessionStates.Load(key); ok {
+		return v.(*sessionState)
+	}
+	v, _ := sessionStates.LoadOrStore(key, &sessionState{
+		authKeyID:  authKeyID,
+		sessionID:  sessionID,
+		outbox:     make(map[int64]*outboundMessage),
+		received:   newReceivedLog(),
+		lastActive: time.Now(),
+	})
+	return v.(*sessionState)
+}
+
+// expireSessionStates drops sessions that have not been used for a day.
+func expireSessionStates() {
+	for range time.Tick(10 * time.Minute) {
+		sessionStates.Range(func(k, v interface{}) bool {
+			s := v.(*sessionState)
+			s.mu.Lock()
+			idle := time.Since(s.lastActive) > sessionIdleExpiry
+			s.mu.Unlock()
+			if idle {
+				sessionStates.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+// isContentRelated reports whether a serialized message body must be
+// acknowledged by its receiver, which also decides the parity of its seqno.
+func isContentRelated(body []byte) bool {
+	if len(body) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(body) {
+	case 0x62d6b459, // msgs_ack
+		0x73f1f8dc, // msg_container
+		0xedab447b, // bad_server_salt
+		0xa7eff811, // bad_msg_notification
+		0x04deb57d, // msgs_state_info
+		0x8cc0d131: // msgs_all_info
+		return false
+	}
+	return true
+}
+
+// nextOutgoing allocates msg_id and seqno for a server message. Content-related
+// messages are kept in the outbox until the client acknowledges them.
+func (s *sessionState) nextOutgoing(body []byte) (msgId int64, seqNo int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgId = mtproto.GenerateMessageId()
+	if msgId <= s.outMsgID {
+		msgId = s.outMsgID + 4
+	}
+	s.outMsgID = msgId
+
+	seqNo = s.outContent * 2
+	if isContentRelated(body) {
+		seqNo++
+		s.outContent++
+		s.keep(msgId, seqNo, body)
+	}
+	return msgId, seqNo
+}
+
+// checkMsgId validates the time and parity of a client msg_id. It returns the
+// bad_msg_notification error code, or 0 if the msg_id is fine.
+func checkMsgId(msgId int64) int32 {
+	now := time.Now().Unix()
+	msgTime := msgId >> 32
+	switch {
+	case msgId&3 != 0:
+		return badMsgIdParity
+	case msgTime < now-msgIdMaxPast:
+		return badMsgIdTooLow
+	case msgTime > now+msgIdMaxFuture:
+		return badMsgIdTooHigh
+	}
+	return 0
+}
+
+// checkSeqNo validates the seqno of a client message against the messages
+// accepted so far and records it. It returns the bad_msg_notification error
+// code, or 0 if the message is accepted.
+func (s *sessionState) checkSeqNo(msgId int64, seqNo int32) int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A newer message may not have a lower seqno, an older one not a higher
+	// one, and two content-related messages never share a seqno.
+	if s.lastMsgID != 0 {
+		switch {
+		case msgId > s.lastMsgID && (seqNo < s.lastSeqNo || seqNo == s.lastSeqNo && seqNo&1 == 1):
+			return badMsgSeqnoTooLow
+		case msgId < s.lastMsgID && (seqNo > s.lastSeqNo || seqNo == s.lastSeqNo && seqNo&1 == 1):
+			return badMsgSeqnoTooHigh
+		}
+	}
+	if msgId > s.lastMsgID {
+		s.lastMsgID, s.lastSeqNo = msgId, seqNo
+	}
+	s.received.add(msgId, seqNo&1 == 1)
+	s.lastActive = time.Now()
+	return 0
+}
+
+// checkServiceLayer validates salt, msg_id and seqno of a decrypted client
+// message. Invalid messages are answered with bad_server_salt or
+// bad_msg_notification and must not be processed further.
+func (cp *ConnProp) checkServiceLayer(msgId int64, seqNo int32, salt, sessionId int64) bool {
+	authKeyID := cp.authKey.AuthKeyId()
+
+	// The salt is checked before the seqno so that a message rejected for its
+	// salt does not count as received when the client sends it again.
+	code := checkMsgId(msgId)
+	if code == 0 {
+		if !validServerSalt(authKeyID, salt) {
+			newSalt := currentServerSalt(authKeyID)
+			logf(1, "[Conn %d] bad_server_salt for msg %d, new salt %d\n", cp.connID, msgId, newSalt)
+			cp.sendBadMsgNotification(&mtproto.TLBadServerSalt{
+				Data2: &mtproto.BadMsgNotification{
+					PredicateName: "bad_server_salt",
+					Constructor:   -307542917,
+					BadMsgId:      msgId,
+					BadMsgSeqno:   seqNo,
+					ErrorCode:     badMsgServerSalt,
+					NewServerSalt: newSalt,
+				},
+			}, newSalt, sessionId)
+			return false
+		}
+		code = getSessionState(authKeyID, sessionId).checkSeqNo(msgId, seqNo)
+	}
+	if code == 0 {
+		return true
+	}
+
+	logf(1, "[Conn %d] bad_msg_notification %d for msg %d (seqno %d)\n", cp.connID, code, msgId, seqNo)
+	cp.sendBadMsgNotification(&mtproto.TLBadMsgNotification{
+		Data2: &mtproto.BadMsgNotification{
+			PredicateName: "bad_msg_notification",
+			Constructor:   -1477445615,
+			BadMsgId:      msgId,
+			BadMsgSeqno:   seqNo,
+			ErrorCode:     code,
+		},
+	}, salt, sessionId)
+	return false
+}
+
+// claimNewSession reports whether the session still has to be announced
+// with new_session_created. It returns true only once per session.
+func (s *sessionState) claimNewSession() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.announced {
+		return false
+	}
+	s.announced = true
+	return true
+}
+
+// sendNewSessionCreated tells the client that the server started a new
+// session with firstMsgId, so it knows messages before it were lost.
+func (cp *ConnProp) sendNewSessionCreated(firstMsgId, sessionId int64) {
+	salt := currentServerSalt(cp.authKey.AuthKeyId())
+	logf(1, "[Conn %d] new_session_created for session %d (first msg %d)\n", cp.connID, sessionId, firstMsgId)
+	created := &mtproto.TLNewSessionCreated{
+		Data2: &mtproto.NewSession{
+			PredicateName: "new_session_created",
+			Constructor:   -1631450872,
+			FirstMsgId:    firstMsgId,
+			UniqueId:      randomSalt(),
+			ServerSalt:    salt,
+		},
+	}
+	buf := mtproto.NewEncodeBuf(32)
+	if err := created.Encode(buf, cp.encodeLayer()); err != nil {
+		logf(1, "[Conn %d] Failed to encode new_session_created: %v\n", cp.connID, err)
+		return
+	}
+	cp.send(buf.GetBuf(), salt, sessionId)
+}
+
+func (cp *ConnProp) sendBadMsgNotification(obj mtproto.TLObject, salt, sessionId int64) {
+	buf := mtproto.NewEncodeBuf(64)
+	if err := obj.Encode(buf, cp.encodeLayer()); err != nil {
+		logf(1, "[Conn %d] Failed to encode %T: %v\n", cp.connID, obj, err)
+		return
+	}
+	cp.send(buf.GetBuf(), salt, sessionId)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// clientMsgId returns a valid client msg_id for t with the given low bits.
+func clientMsgId(t time.Time, low int64) int64 {
+	return t.Unix()<<32 | low
+}
+
+func constructorBody(constructor uint32) []byte {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint32(body, constructor)
+	return body
+}
+
+func TestIsContentRelated(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"short", []byte{1, 2, 3}, false},
+		{"msgs_ack", constructorBody(0x62d6b459), false},
+		{"msg_container", constructorBody(0x73f1f8dc), false},
+		{"bad_server_salt", constructorBody(0xedab447b), false},
+		{"bad_msg_notification", constructorBody(0xa7eff811), false},
+		{"msgs_state_info", constructorBody(0x04deb57d), false},
+		{"msgs_all_info", constructorBody(0x8cc0d131), false},
+		{"rpc_result", constructorBody(0xf35c6d01), true},
+		{"pong", constructorBody(0x347773c5), true},
+	}
+	for _, tt := range tests {
+		if got := isContentRelated(tt.body); got != tt.want {
+			t.Errorf("%s: isContentRelated = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMsgId(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		msgId int64
+		want  int32
+	}{
+		{"now", clientMsgId(now, 0x1000), 0},
+		{"odd", clientMsgId(now, 0x1001), badMsgIdParity},
+		{"server parity", clientMsgId(now, 0x1002), badMsgIdParity},
+		{"slightly old", clientMsgId(now.Add(-time.Minute), 0), 0},
+		{"too old", clientMsgId(now.Add(-(msgIdMaxPast+60)*time.Second), 0), badMsgIdTooLow},
+		{"slightly ahead", clientMsgId(now.Add(10*time.Second), 0), 0},
+		{"too far ahead", clientMsgId(now.Add((msgIdMaxFuture+60)*time.Second), 0), badMsgIdTooHigh},
+	}
+	for _, tt := range tests {
+		if got := checkMsgId(tt.msgId); got != tt.want {
+			t.Errorf("%s: checkMsgId = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSeqNo(t *testing.T) {
+	base := clientMsgId(time.Now(), 0)
+	type msg struct {
+		msgId int64
+		seqNo int32
+		want  int32
+	}
+	tests := []struct {
+		name string
+		msgs []msg
+	}{
+		{"increasing", []msg{{base, 1, 0}, {base + 4, 3, 0}, {base + 8, 4, 0}}},
+		{"service messages share seqno", []msg{{base, 2, 0}, {base + 4, 2, 0}}},
+		{"newer with lower seqno", []msg{{base, 5, 0}, {base + 4, 3, badMsgSeqnoTooLow}}},
+		{"content-related seqno reused", []msg{{base, 3, 0}, {base + 4, 3, badMsgSeqnoTooLow}}},
+		{"older with higher seqno", []msg{{base + 8, 3, 0}, {base, 5, badMsgSeqnoTooHigh}}},
+		{"older with lower seqno", []msg{{base + 8, 5, 0}, {base, 3, 0}}},
+	}
+	for _, tt := range tests {
+		s := &sessionState{received: newReceivedLog()}
+		for i, m := range tt.msgs {
+			if got := s.checkSeqNo(m.msgId, m.seqNo); got != m.want {
+				t.Errorf("%s: message %d: checkSeqNo = %d, want %d", tt.name, i, got, m.want)
+			}
+		}
+	}
+}
+
+func TestNextOutgoing(t *testing.T) {
+	s := &sessionState{outbox: make(map[int64]*outboundMessage), received: newReceivedLog()}
+	bodies := []struct {
+		body      []byte
+		wantSeqNo int32
+	}{
+		{constructorBody(0x62d6b459), 0}, // msgs_ack
+		{constructorBody(0xf35c6d01), 1}, // rpc_result
+		{constructorBody(0xf35c6d01), 3},
+		{constructorBody(0x73f1f8dc), 4}, // msg_container
+		{constructorBody(0xf35c6d01), 5},
+	}
+	var last int64
+	for i, b := range bodies {
+		msgId, seqNo := s.nextOutgoing(b.body)
+		if seqNo != b.wantSeqNo {
+			t.Errorf("message %d: seqno = %d, want %d", i, seqNo, b.wantSeqNo)
+		}
+		if msgId <= last {
+			t.Errorf("message %d: msg_id %d not above %d", i, msgId, last)
+		}
+		if msgId&3 == 0 {
+			t.Errorf("message %d: msg_id %d has client parity", i, msgId)
+		}
+		last = msgId
+	}
+	if len(s.outbox) != 3 {
+		t.Errorf("outbox has %d messages, want the 3 content-related ones", len(s.outbox))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+// bindAuthKeyInnerSize is the serialized size of bind_auth_key_inner.
+const bindAuthKeyInnerSize = 40
+
+// authKeyPurgeInterval is how often expired temp auth keys are deleted.
+const authKeyPurgeInterval = 10 * time.Minute
+
+// decodeBindMessage decrypts the encrypted_message of auth.bindTempAuthKey
+// with the permanent key (MTProto 1.0 framing) and returns the
+// bind_auth_key_inner it carries, or nil if the message is not valid.
+func decodeBindMessage(perm *authKeyInfo, msgId int64, encrypted []byte) *mtproto.TLBindAuthKeyInner {
+	// auth_key_id(8) msg_key(16) encrypted_data, which holds the 32 byte
+	// header and the inner object padded to a multiple of 16 bytes
+	if len(encrypted) < 8+16+32+bindAuthKeyInnerSize || (len(encrypted)-24)%16 != 0 {
+		return nil
+	}
+	if int64(binary.LittleEndian.Uint64(encrypted[:8])) != perm.key.AuthKeyId() {
+		return nil
+	}
+	// The error text includes key material, so it is never logged
+	plaintext, err := perm.key.AesIgeDecryptV1(encrypted[8:24], encrypted[24:])
+	if err != nil {
+		return nil
+	}
+
+	// random(8) random(8) msg_id(8) seqno(4) length(4) bind_auth_key_inner
+	if int64(binary.LittleEndian.Uint64(plaintext[16:24])) != msgId ||
+		binary.LittleEndian.Uint32(plaintext[24:28]) != 0 ||
+		binary.LittleEndian.Uint32(plaintext[28:32]) != bindAuthKeyInnerSize {
+		return nil
+	}
+	dBuf := mtproto.NewDecodeBuf(plaintext[32 : 32+bindAuthKeyInnerSize])
+	inner, ok := dBuf.Object().(*mtproto.TLBindAuthKeyInner)
+	if !ok || dBuf.GetError() != nil {
+		return nil
+	}
+	return inner
+}
+
+// HandleAuthBindTempAuthKey handles TL_auth_bindTempAuthKey requests
+func (cp *ConnProp) HandleAuthBindTempAuthKey(obj *mtproto.TLAuthBindTempAuthKey, msgId, salt, sessionId int64) {
+	temp := cp.keyInfo
+	if temp == nil || !temp.temp {
+		cp.sendRpcError(mtproto.ErrTempAuthKeyEmpty, msgId, salt, sessionId)
+		return
+	}
+	if temp.permAuthKeyID != 0 && temp.permAuthKeyID != obj.GetPermAuthKeyId() {
+		cp.sendRpcError(mtproto.ErrTempAuthKeyAlreadyBound, msgId, salt, sessionId)
+		return
+	}
+
+	perm, err := lookupAuthKey(obj.GetPermAuthKeyId())
+	if err != nil {
+		logf(1, "[Conn %d] Failed to look up auth key %d: %v\n", cp.connID, obj.GetPermAuthKeyId(), err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	if perm == nil || perm.temp {
+		logf(1, "[Conn %d] bindTempAuthKey: %d is not a permanent auth key\n", cp.connID, obj.GetPermAuthKeyId())
+		cp.sendRpcError(mtproto.ErrEncryptedMessageInvalid, msgId, salt, sessionId)
+		return
+	}
+
+	inner := decodeBindMessage(perm, msgId, obj.GetEncryptedMessage())
+	if inner == nil ||
+		inner.GetNonce() != obj.GetNonce() ||
+		inner.GetTempAuthKeyId() != cp.authKey.AuthKeyId() ||
+		inner.GetPermAuthKeyId() != obj.GetPermAuthKeyId() ||
+		inner.GetTempSessionId() != sessionId ||
+		inner.GetExpiresAt() != obj.GetExpiresAt() {
+		logf(1, "[Conn %d] bindTempAuthKey: invalid binding message for temp key %d\n", cp.connID, cp.authKey.AuthKeyId())
+		cp.sendRpcError(mtproto.ErrEncryptedMessageInvalid, msgId, salt, sessionId)
+		return
+	}
+
+	// The binding can't outlive the temp key
+	expiresAt := time.Unix(int64(obj.GetExpiresAt()), 0)
+	if expiresAt.After(temp.expiresAt) {
+		expiresAt = temp.expiresAt
+	}
+	if err := BindTempAuthKey(cp.authKey.AuthKeyId(), obj.GetPermAuthKeyId(), expiresAt); err != nil {
+		logf(1, "[Conn %d] Failed to bind temp auth key: %v\n", cp.connID, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+
+	bound := *temp
+	bound.permAuthKeyID = obj.GetPermAuthKeyId()
+	bound.expiresAt = expiresAt
+	cp.mu.Lock()
+	cp.keyInfo = &bound
+	cp.mu.Unlock()
+	authKeys.put(cp.authKey.AuthKeyId(), &bound)
+
+	// The connection is now logged in as whoever the permanent key belongs to
+	cp.setUserID(0)
+	if session, err := FindSessionByAuthKey(bound.permAuthKeyID); err == nil && session != nil {
+		cp.setUserID(session.UserID)
+	}
+	logf(1, "[Conn %d] Temp auth key %d bound to %d until %s (user %d)\n",
+		cp.connID, cp.authKey.AuthKeyId(), bound.permAuthKeyID, expiresAt.Format(time.RFC3339), cp.userID)
+
+	cp.encodeAndSend(mtproto.MakeTLBoolTrue(nil), msgId, salt, sessionId, 64)
+}
+
+// purgeExpiredAuthKeys periodically deletes expired temp auth keys and
+// forgets everything kept in memory for them.
+func purgeExpiredAuthKeys() {
+	for range time.Tick(authKeyPurgeInterval) {
+		ids, err := PurgeExpiredAuthKeys()
+		if err != nil {
+			logf(1, "Failed to purge expired auth keys: %v\n", err)
+		}
+		for _, id := range ids {
+			forgetAuthKey(id)
+		}
+		if len(ids) > 0 {
+			logf(1, "Purged %d expired temp auth key(s)\n", len(ids))
+		}
+	}
+}
+
+// forgetAuthKey drops the cached key, salts and session states of authKeyID.
+func forgetAuthKey(authKeyID int64) {
+	authKeys.remove(authKeyID)
+	saltManagers.Delete(authKeyID)
+	sessionStates.Range(func(k, _ interface{}) bool {
+		if k.(sessionKey).authKeyID == authKeyID {
+			sessionStates.Delete(k)
+		}
+		return true
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// MTProto transport protocol tags. A plain connection starts with the tag
+// (a single 0xef byte for abridged), an obfuscated one carries it in bytes
+// 56..60 of the decrypted 64-byte init header. The full transport has no tag.
+const (
+	transportAbridged           uint32 = 0xefefefef
+	transportIntermediate       uint32 = 0xeeeeeeee
+	transportPaddedIntermediate uint32 = 0xdddddddd
+	transportFull               uint32 = 0
+)
+
+// maxFrameSize bounds a single transport frame (upload parts are 512KB).
+const maxFrameSize = 4 * 1024 * 1024
+
+// Transport errors are sent as a frame holding just the negative error code.
+const (
+	transportErrAuthKeyNotFound int32 = -404 // auth_key_id unknown (AUTH_KEY_UNREGISTERED)
+	transportErrFlood           int32 = -429 // Too many connections or messages from the client's IP
+)
+
+// transport reassembles MTProto frames from the (already deobfuscated) byte
+// stream of a connection and frames outgoing payloads the same way.
+type transport struct {
+	tag    uint32
+	r      *bufio.Reader
+	inSeq  int32 // Full transport: next expected client seqno
+	outSeq int32 // Full transport: next server seqno
+}
+
+// ctrReader decrypts everything read from the underlying reader with the
+// connection's AES-CTR codec.
+type ctrReader struct {
+	r     io.Reader
+	codec *AesCTR128Crypto
+}
+
+func (c *ctrReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.codec.Decrypt(p[:n])
+	}
+	return n, err
+}
+
+func transportName(tag uint32) string {
+	switch tag {
+	case transportAbridged:
+		return "abridged"
+	case transportIntermediate:
+		return "intermediate"
+	case transportPaddedIntermediate:
+		return "padded intermediate"
+	case transportFull:
+		return "full"
+	}
+	return fmt.Sprintf("unknown(0x%08x)", tag)
+}
+
+// detectTransport inspects the first bytes of a connection, sets up
+// obfuscation if the client uses it and returns the transport to read frames
+// with.
+func (cp *ConnProp) detectTransport(raw *bufio.Reader) (*transport, error) {
+	head, err := raw.Peek(8)
+	if err != nil {
+		return nil, err
+	}
+
+	// With a proxy secret only obfuscated connections are allowed
+	if proxySecret == nil {
+		switch {
+		case head[0] == 0xef:
+			raw.Discard(1)
+			return &transport{tag: transportAbridged, r: raw}, nil
+		case binary.LittleEndian.Uint32(head) == transportIntermediate:
+			raw.Discard(4)
+			return &transport{tag: transportIntermediate, r: raw}, nil
+		case binary.LittleEndian.Uint32(head) == transportPaddedIntermediate:
+			raw.Discard(4)
+			return &transport{tag: transportPaddedIntermediate, r: raw}, nil
+		case binary.LittleEndian.Uint32(head[4:]) == 0:
+			// Full transport: length followed by seqno 0 of the first packet.
+			// Obfuscated headers never have zero there.
+			return &transport{tag: transportFull, r: raw}, nil
+		}
+	}
+
+	// Obfuscated connection: 64-byte init header, then AES-CTR stream
+	header := make([]byte, 64)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+	codec, tag, dcID, err := newObfuscated2Codec(header, proxySecret)
+	if err != nil {
+		return nil, err
+	}
+	cp.aesCtr = codec
+	cp.dcID = dcID
+
+	r := bufio.NewReaderSize(&ctrReader{r: raw, codec: cp.aesCtr}, 64*1024)
+	return &transport{tag: tag, r: r}, nil
+}
+
+// readFrame blocks until a whole frame has arrived and returns its payload.
+func (t *transport) readFrame() ([]byte, error) {
+	var size int
+
+	switch t.tag {
+	case transportAbridged:
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		size = int(b & 0x7f) // high bit requests a quick ack
+		if size == 0x7f {
+			var l [4]byte
+			if _, err := io.ReadFull(t.r, l[:3]); err != nil {
+				return nil, err
+			}
+			size = int(binary.LittleEndian.Uint32(l[:]))
+		}
+		size *= 4
+	case transportIntermediate, transportPaddedIntermediate:
+		var l [4]byte
+		if _, err := io.ReadFull(t.r, l[:]); err != nil {
+			return nil, err
+		}
+		size = int(binary.LittleEndian.Uint32(l[:]) & 0x7fffffff)
+	case transportFull:
+		return t.readFullFrame()
+	default:
+		return nil, fmt.Errorf("unsupported transport %s", transportName(t.tag))
+	}
+
+	if size <= 0 || size > maxFrameSize {
+		return nil, fmt.Errorf("invalid %s frame size %d", transportName(t.tag), size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(t.r, payload); err != nil {
+		return nil, err
+	}
+	if t.tag == transportPaddedIntermediate {
+		payload = stripFramePadding(payload)
+	}
+	return payload, nil
+}
+
+// readFullFrame reads len(4) seqno(4) payload crc32(4) and verifies the
+// checksum and sequence number.
+func (t *transport) readFullFrame() ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(t.r, l[:]); err != nil {
+		return nil, err
+	}
+	total := int(binary.LittleEndian.Uint32(l[:]))
+	if total < 12 || total > maxFrameSize || total%4 != 0 {
+		return nil, fmt.Errorf("invalid full frame size %d", total)
+	}
+
+	frame := make([]byte, total)
+	copy(frame, l[:])
+	if _, err := io.ReadFull(t.r, frame[4:]); err != nil {
+		return nil, err
+	}
+
+	crc := binary.LittleEndian.Uint32(frame[total-4:])
+	if crc32.ChecksumIEEE(frame[:total-4]) != crc {
+		return nil, fmt.Errorf("full frame crc32 mismatch")
+	}
+	seq := int32(binary.LittleEndian.Uint32(frame[4:8]))
+	if seq != t.inSeq {
+		return nil, fmt.Errorf("full frame seqno %d, expected %d", seq, t.inSeq)
+	}
+	t.inSeq++
+
+	return frame[8 : total-4], nil
+}
+
+// stripFramePadding removes the 0..15 random bytes the padded intermediate
+// transport appends, using the MTProto message layout to find the real end.
+func stripFramePadding(payload []byte) []byte {
+	if len(payload) < 24 {
+		return payload
+	}
+	if binary.LittleEndian.Uint64(payload[:8]) == 0 {
+		// auth_key_id(8) + msg_id(8) + length(4) + body
+		end := 20 + int(binary.LittleEndian.Uint32(payload[16:20]))
+		if end <= len(payload) {
+			return payload[:end]
+		}
+		return payload
+	}
+	// auth_key_id(8) + msg_key(16) + encrypted data (multiple of 16)
+	return payload[:24+(len(payload)-24)/16*16]
+}
+
+// encodeFrame wraps payload in this transport's framing.
+func (t *transport) encodeFrame(payload []byte) []byte {
+	switch t.tag {
+	case transportIntermediate:
+		frame := make([]byte, 4, 4+len(payload))
+		binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+		return append(frame, payload...)
+	case transportPaddedIntermediate:
+		var p [1]byte
+		rand.Read(p[:])
+		padding := make([]byte, int(p[0]%16))
+		rand.Read(padding)
+		frame := make([]byte, 4, 4+len(payload)+len(padding))
+		binary.LittleEndian.PutUint32(frame, uint32(len(payload)+len(padding)))
+		frame = append(frame, payload...)
+		return append(frame, padding...)
+	case transportFull:
+		frame := make([]byte, 8, 12+len(payload))
+		binary.LittleEndian.PutUint32(frame, uint32(12+len(payload)))
+		binary.LittleEndian.PutUint32(frame[4:], uint32(t.outSeq))
+		t.outSeq++
+		frame = append(frame, payload...)
+		var crc [4]byte
+		binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(frame))
+		return append(frame, crc[:]...)
+	default: // abridged
+		size := len(payload) / 4
+		sb := []byte{byte(size)}
+		if size >= 127 {
+			sb = make([]byte, 4)
+			binary.LittleEndian.PutUint32(sb, uint32(size<<8|127))
+		}
+		return append(sb, payload...)
+	}
+}
+
+// sendTransportError writes a transport error frame.
+func (cp *ConnProp) sendTransportError(code int32) {
+	var frame [4]byte
+	binary.LittleEndian.PutUint32(frame[:], uint32(code))
+	cp.writeFrame(frame[:])
+}
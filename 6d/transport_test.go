@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/teamgram/proto/mtproto/crypto"
+)
+
+// encryptedPayload is shaped like an encrypted message: auth_key_id,
+// msg_key and n blocks of data.
+func encryptedPayload(n int) []byte {
+	p := crypto.GenerateNonce(24 + 16*n)
+	p[0] |= 1 // Non-zero auth_key_id
+	return p
+}
+
+// plainPayload is shaped like an unencrypted message with a body of n bytes.
+func plainPayload(n int) []byte {
+	p := make([]byte, 20, 20+n)
+	binary.LittleEndian.PutUint64(p[8:16], 0x5f3c000000000000)
+	binary.LittleEndian.PutUint32(p[16:20], uint32(n))
+	return append(p, crypto.GenerateNonce(n)...)
+}
+
+func TestTransportRoundTrip(t *testing.T) {
+	payloads := [][]byte{
+		encryptedPayload(1),
+		plainPayload(40),
+		encryptedPayload(64), // Abridged length no longer fits in one byte
+		encryptedPayload(1024),
+	}
+	for _, tag := range []uint32{transportAbridged, transportIntermediate, transportPaddedIntermediate, transportFull} {
+		writer := &transport{tag: tag}
+		var stream []byte
+		for _, p := range payloads {
+			stream = append(stream, writer.encodeFrame(p)...)
+		}
+
+		reader := &transport{tag: tag, r: bufio.NewReader(bytes.NewReader(stream))}
+		for i, want := range payloads {
+			got, err := reader.readFrame()
+			if err != nil {
+				t.Errorf("%s: frame %d: %v", transportName(tag), i, err)
+				break
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: frame %d has %d bytes, want the %d sent", transportName(tag), i, len(got), len(want))
+			}
+		}
+		if _, err := reader.readFrame(); err == nil {
+			t.Errorf("%s: read a frame past the end of the stream", transportName(tag))
+		}
+	}
+}
+
+func TestReadFullFrameErrors(t *testing.T) {
+	valid := func() []byte {
+		return (&transport{tag: transportFull}).encodeFrame(encryptedPayload(1))
+	}
+	tests := []struct {
+		name  string
+		frame func() []byte
+		inSeq int32
+	}{
+		{"crc32 mismatch", func() []byte {
+			f := valid()
+			f[10] ^= 1
+			return f
+		}, 0},
+		{"seqno out of order", valid, 1},
+		{"too short", func() []byte {
+			f := make([]byte, 8)
+			binary.LittleEndian.PutUint32(f, 8)
+			return f
+		}, 0},
+		{"not a multiple of 4", func() []byte {
+			f := valid()
+			binary.LittleEndian.PutUint32(f, uint32(len(f)-1))
+			return f
+		}, 0},
+		{"too large", func() []byte {
+			f := valid()
+			binary.LittleEndian.PutUint32(f, maxFrameSize+4)
+			return f
+		}, 0},
+	}
+	for _, tt := range tests {
+		tr := &transport{tag: transportFull, r: bufio.NewReader(bytes.NewReader(tt.frame())), inSeq: tt.inSeq}
+		if _, err := tr.readFrame(); err == nil {
+			t.Errorf("%s: frame accepted", tt.name)
+		}
+	}
+}
+
+func TestReadFrameInvalidSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		tag    uint32
+		stream []byte
+	}{
+		{"abridged empty", transportAbridged, []byte{0}},
+		{"abridged too large", transportAbridged, []byte{0x7f, 0xff, 0xff, 0xff}},
+		{"intermediate empty", transportIntermediate, []byte{0, 0, 0, 0}},
+		{"intermediate too large", transportIntermediate, []byte{0, 0, 0, 0x7f}},
+	}
+	for _, tt := range tests {
+		tr := &transport{tag: tt.tag, r: bufio.NewReader(bytes.NewReader(tt.stream))}
+		if _, err := tr.readFrame(); err == nil {
+			t.Errorf("%s: frame accepted", tt.name)
+		}
+	}
+}
+
+func TestStripFramePadding(t *testing.T) {
+	encrypted, plain := encryptedPayload(2), plainPayload(12)
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []byte
+	}{
+		{"encrypted", append(encrypted, 1, 2, 3), encrypted},
+		{"encrypted 15 bytes", append(encrypted, make([]byte, 15)...), encrypted},
+		{"plain", append(plain, 1, 2, 3, 4, 5), plain},
+		{"plain without padding", plain, plain},
+		{"too short", []byte{1, 2, 3}, []byte{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		if got := stripFramePadding(tt.payload); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %d bytes, want %d", tt.name, len(got), len(tt.want))
+		}
+	}
+}
+
+func TestDetectTransport(t *testing.T) {
+	fullHead := make([]byte, 8)
+	binary.LittleEndian.PutUint32(fullHead, 12)
+	tests := []struct {
+		name     string
+		head     []byte
+		wantTag  uint32
+		wantRest int // Bytes left in the reader after detection
+	}{
+		{"abridged", []byte{0xef, 1, 2, 3, 4, 5, 6, 7}, transportAbridged, 7},
+		{"intermediate", []byte{0xee, 0xee, 0xee, 0xee, 1, 2, 3, 4}, transportIntermediate, 4},
+		{"padded intermediate", []byte{0xdd, 0xdd, 0xdd, 0xdd, 1, 2, 3, 4}, transportPaddedIntermediate, 4},
+		{"full", fullHead, transportFull, 8},
+	}
+	for _, tt := range tests {
+		raw := bufio.NewReader(bytes.NewReader(tt.head))
+		tr, err := (&ConnProp{}).detectTransport(raw)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tr.tag != tt.wantTag || raw.Buffered() != tt.wantRest {
+			t.Errorf("%s: detected %s with %d bytes left, want %s with %d", tt.name, transportName(tr.tag), raw.Buffered(), transportName(tt.wantTag), tt.wantRest)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+)
+
+// connectionsForUser returns every live, authenticated connection of userID
+// that has already told us which session it is using and did not opt out of
+// updates with invokeWithoutUpdates.
+func connectionsForUser(userID int64) []*ConnProp {
+	var conns []*ConnProp
+	activeConnections.Range(func(_, v interface{}) bool {
+		cp := v.(*ConnProp)
+		if id, authKeyID := cp.identity(); id != userID || authKeyID == 0 {
+			return true
+		}
+		cp.mu.Lock()
+		sessionID, withoutUpdates := cp.sessionID, cp.withoutUpdates
+		cp.mu.Unlock()
+		if sessionID != 0 && !withoutUpdates {
+			conns = append(conns, cp)
+		}
+		return true
+	})
+	return conns
+}
+
+// pushUpdatesToUser sends a server-initiated Updates object to every live
+// session of userID. The connection in except (usually the one that caused
+// the update and already got it inside its rpc_result) is skipped.
+// Returns the number of sessions the update was written to.
+func pushUpdatesToUser(userID int64, updates mtproto.TLObject, except *ConnProp) int {
+	delivered := 0
+	for _, cp := range connectionsForUser(userID) {
+		if cp == except {
+			continue
+		}
+		cp.pushUpdates(updates)
+		delivered++
+	}
+	if delivered > 0 {
+		logf(1, "Pushed %T to %d session(s) of user %d\n", updates, delivered, userID)
+	}
+	return delivered
+}
+
+// pushUpdatesToAuthKey sends a server-initiated Updates object to every live
+// session of authKeyID, logged in or not. Returns the number of sessions the
+// update was written to.
+func pushUpdatesToAuthKey(authKeyID int64, updates mtproto.TLObject) int {
+	delivered := 0
+	activeConnections.Range(func(_, v interface{}) bool {
+		cp := v.(*ConnProp)
+		if _, id := cp.identity(); id == 0 || id != authKeyID {
+			return true
+		}
+		cp.mu.Lock()
+		sessionID := cp.sessionID
+		cp.mu.Unlock()
+		if sessionID != 0 {
+			cp.pushUpdates(updates)
+			delivered++
+		}
+		return true
+	})
+	if delivered > 0 {
+		logf(1, "Pushed %T to %d session(s) of auth key %d\n", updates, delivered, authKeyID)
+	}
+	return delivered
+}
+
+// pushUpdates writes updates to this connection's current session without an
+// rpc_result wrapper.
+func (cp *ConnProp) pushUpdates(updates mtproto.TLObject) {
+	cp.mu.Lock()
+	salt, sessionId := cp.salt, cp.sessionID
+	cp.mu.Unlock()
+
+	buf := mtproto.NewEncodeBuf(512)
+	if err := updates.Encode(buf, cp.encodeLayer()); err != nil {
+		logf(1, "[Conn %d] Failed to encode pushed updates: %v\n", cp.connID, err)
+		return
+	}
+	cp.send(buf.GetBuf(), salt, sessionId)
+}
+
+// makeUpdateShortMessage builds the compact envelope for a private message as
+// seen by the user on the other side of peerUserID.
+func makeUpdateShortMessage(id int32, peerUserID int64, out bool, message string, pts, ptsCount, date int32) *mtproto.TLUpdateShortMessage {
+	return &mtproto.TLUpdateShortMessage{
+		Data2: &mtproto.Updates{
+			PredicateName: "updateShortMessage",
+			Constructor:   826001400,
+			Out:           out,
+			Id:            id,
+			UserId:        peerUserID,
+			Message:       message,
+			Pts:           pts,
+			PtsCount:      ptsCount,
+			Date:          date,
+		},
+	}
+}
+
+// makeUpdatesEnvelope wraps pts-bearing updates into a plain updates object
+// for pushing.
+func makeUpdatesEnvelope(updates ...*mtproto.Update) *mtproto.TLUpdates {
+	return &mtproto.TLUpdates{
+		Data2: &mtproto.Updates{
+			PredicateName: "updates",
+			Constructor:   1957577280,
+			Updates:       updates,
+			Users:         []*mtproto.User{},
+			Chats:         []*mtproto.Chat{},
+			Date:          int32(time.Now().Unix()),
+			Seq:           0,
+		},
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/teamgram/proto/mtproto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Update log entry types
+const (
+	UpdateTypeNewMessage        = "new_message"
+	UpdateTypeEditMessage       = "edit_message"
+	UpdateTypeDeleteMessages    = "delete_messages"
+	UpdateTypeReadHistoryInbox  = "read_history_inbox"
+	UpdateTypeReadHistoryOutbox = "read_history_outbox"
+)
+
+// UpdateLogDoc is one entry of a user's update journal. Every pts-bearing
+// change visible to a user gets its own entry, numbered from that user's pts
+// sequence (UserDoc.Pts), so the sender and the recipient of the same message
+// each see it at their own pts.
+type UpdateLogDoc struct {
+	UserID   int64  `bson:"user_id"`   // Owner of this journal entry
+	Pts      int32  `bson:"pts"`       // Pts after applying this entry
+	PtsCount int32  `bson:"pts_count"` // Pts units consumed by this entry
+	Type     string `bson:"type"`      // One of the UpdateType* constants
+	Date     int32  `bson:"date"`      // Unix timestamp of the change
+
+	PeerUserID int64   `bson:"peer_user_id"`          // The other user of the dialog
+	MessageID  int32   `bson:"message_id,omitempty"`  // new_message, edit_message
+	FromID     int64   `bson:"from_id,omitempty"`     // new_message, edit_message
+	Out        bool    `bson:"out,omitempty"`         // new_message, edit_message (from the owner's point of view)
+	Message    string  `bson:"message,omitempty"`     // new_message, edit_message
+	MessageIDs []int32 `bson:"message_ids,omitempty"` // delete_messages
+	MaxID      int32   `bson:"max_id,omitempty"`      // read_history_*
+
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// updateGapGrace is how long getDifference waits for a journal entry whose pts
+// was allocated but not stored yet. AppendUserUpdate gives up after 5 seconds,
+// so an older hole is an append that failed and will never be filled.
+const updateGapGrace = 10 * time.Second
+
+// AppendUserUpdate allocates the next pts range of entry.UserID and stores the
+// entry in the journal. entry.Pts is filled in on success.
+func AppendUserUpdate(entry *UpdateLogDoc) error {
+	if entry.PtsCount == 0 {
+		entry.PtsCount = 1
+	}
+
+	pts, err := IncrementUserPts(entry.UserID, entry.PtsCount)
+	if err != nil {
+		return err
+	}
+	entry.Pts = pts
+	if entry.Date == 0 {
+		entry.Date = int32(time.Now().Unix())
+	}
+	entry.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := updateLogCollection.InsertOne(ctx, entry); err != nil {
+		return fmt.Errorf("failed to append update: %w", err)
+	}
+	return nil
+}
+
+// GetUserUpdatesSince returns up to limit journal entries of userID with
+// pts greater than fromPts, oldest first.
+func GetUserUpdatesSince(userID int64, fromPts int32, limit int64) ([]UpdateLogDoc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"user_id": userID,
+		"pts":     bson.M{"$gt": fromPts},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "pts", Value: 1}}).SetLimit(limit)
+
+	cursor, err := updateLogCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []UpdateLogDoc
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// contiguousUpdates returns the leading entries that continue fromPts without
+// a hole. Holes followed by an entry older than updateGapGrace are skipped.
+func contiguousUpdates(entries []UpdateLogDoc, fromPts int32, now time.Time) []UpdateLogDoc {
+	pts := fromPts
+	for i := range entries {
+		if entries[i].Pts-entries[i].PtsCount != pts && now.Sub(entries[i].CreatedAt) < updateGapGrace {
+			return entries[:i]
+		}
+		pts = entries[i].Pts
+	}
+	return entries
+}
+
+// ToMessage returns the message carried by a new_message or edit_message
+// entry, as seen by the journal owner.
+func (e *UpdateLogDoc) ToMessage() *mtproto.Message {
+	return &mtproto.Message{
+		PredicateName: "message",
+		Constructor:   940666592,
+		Id:            e.MessageID,
+		Out:           e.Out,
+		PeerId: &mtproto.Peer{
+			PredicateName: "peerUser",
+			Constructor:   1498486562,
+			UserId:        e.PeerUserID},
+		FromId: &mtproto.Peer{
+			PredicateName: "peerUser",
+			Constructor:   1498486562,
+			UserId:        e.FromID},
+		Date:    e.Date,
+		Message: e.Message,
+	}
+}
+
+// ToUpdate converts the entry to the Update the client applies at e.Pts.
+func (e *UpdateLogDoc) ToUpdate() *mtproto.Update {
+	peer := &mtproto.Peer{
+		PredicateName: "peerUser",
+		Constructor:   1498486562,
+		UserId:        e.PeerUserID,
+	}
+
+	switch e.Type {
+	case UpdateTypeNewMessage:
+		return &mtproto.Update{
+			PredicateName:   "updateNewMessage",
+			Constructor:     522914557,
+			Message_MESSAGE: e.ToMessage(),
+			Pts_INT32:       e.Pts,
+			PtsCount:        e.PtsCount,
+		}
+	case UpdateTypeEditMessage:
+		return &mtproto.Update{
+			PredicateName:   "updateEditMessage",
+			Constructor:     -469536605,
+			Message_MESSAGE: e.ToMessage(),
+			Pts_INT32:       e.Pts,
+			PtsCount:        e.PtsCount,
+		}
+	case UpdateTypeDeleteMessages:
+		return &mtproto.Update{
+			PredicateName: "updateDeleteMessages",
+			Constructor:   -1576161051,
+			Messages:      e.MessageIDs,
+			Pts_INT32:     e.Pts,
+			PtsCount:      e.PtsCount,
+		}
+	case UpdateTypeReadHistoryInbox:
+		return &mtproto.Update{
+			PredicateName: "updateReadHistoryInbox",
+			Constructor:   -1667805217,
+			Peer_PEER:     peer,
+			MaxId:         e.MaxID,
+			Pts_INT32:     e.Pts,
+			PtsCount:      e.PtsCount,
+		}
+	case UpdateTypeReadHistoryOutbox:
+		return &mtproto.Update{
+			PredicateName: "updateReadHistoryOutbox",
+			Constructor:   791617983,
+			Peer_PEER:     peer,
+			MaxId:         e.MaxID,
+			Pts_INT32:     e.Pts,
+			PtsCount:      e.PtsCount,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContiguousUpdates(t *testing.T) {
+	now := time.Now()
+	fresh, stale := now.Add(-time.Second), now.Add(-2*updateGapGrace)
+	entry := func(pts, ptsCount int32, createdAt time.Time) UpdateLogDoc {
+		return UpdateLogDoc{Pts: pts, PtsCount: ptsCount, CreatedAt: createdAt}
+	}
+
+	tests := []struct {
+		name    string
+		fromPts int32
+		entries []UpdateLogDoc
+		wantPts []int32
+	}{
+		{"none", 5, nil, nil},
+		{"contiguous", 5, []UpdateLogDoc{entry(6, 1, fresh), entry(8, 2, fresh), entry(9, 1, fresh)}, []int32{6, 8, 9}},
+		{"fresh hole first", 5, []UpdateLogDoc{entry(7, 1, fresh), entry(8, 1, fresh)}, []int32{}},
+		{"fresh hole in the middle", 5, []UpdateLogDoc{entry(6, 1, fresh), entry(8, 1, fresh), entry(9, 1, fresh)}, []int32{6}},
+		{"stale hole", 5, []UpdateLogDoc{entry(6, 1, stale), entry(8, 1, stale), entry(9, 1, fresh)}, []int32{6, 8, 9}},
+		{"stale hole then fresh hole", 5, []UpdateLogDoc{entry(7, 1, stale), entry(9, 1, fresh)}, []int32{7}},
+		{"pts_count spans the gap", 5, []UpdateLogDoc{entry(8, 3, fresh)}, []int32{8}},
+	}
+	for _, tt := range tests {
+		got := contiguousUpdates(tt.entries, tt.fromPts, now)
+		if len(got) != len(tt.wantPts) {
+			t.Errorf("%s: got %d entries, want %d", tt.name, len(got), len(tt.wantPts))
+			continue
+		}
+		for i := range got {
+			if got[i].Pts != tt.wantPts[i] {
+				t.Errorf("%s: entry %d has pts %d, want %d", tt.name, i, got[i].Pts, tt.wantPts[i])
+			}
+		}
+	}
+}
@@ -7,12 +7,18 @@ import (
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
+const (
+	differenceSliceLimit = 100   // Journal entries returned per updates.differenceSlice
+	differenceTooLongGap = 10000 // Pts gap after which the client must refetch its state
+)
+
 // HandleUpdatesGetDifference handles TL_updates_getDifference requests
 func (cp *ConnProp) HandleUpdatesGetDifference(obj *mtproto.TLUpdatesGetDifference, msgId, salt, sessionId int64) {
 	logf(1, "[Conn %d] updates.getDifference for user %d\n", cp.connID, cp.userID)
 
 	if cp.userID == 0 {
 		logf(1, "[Conn %d] Not authenticated\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
 		return
 	}
 
@@ -35,115 +41,99 @@ func (cp *ConnProp) HandleUpdatesGetDifference(obj *mtproto.TLUpdatesGetDifferen
 
 	logf(1, "[Conn %d] Server state: pts=%d, qts=%d, seq=%d, date=%d\n", cp.connID, serverPts, serverQts, serverSeq, serverDate)
 
-	// Get pending messages (messages sent to this user that they haven't received)
-	pendingMessages, err := GetPendingMessages(cp.userID, clientPts)
-	if err != nil {
-		logf(1, "[Conn %d] Failed to get pending messages: %v\n", cp.connID, err)
-		pendingMessages = []MessageDoc{}
+	// Nothing new since the client's pts
+	if clientPts >= serverPts {
+		cp.sendDifferenceEmpty(serverDate, serverSeq, msgId, salt, sessionId)
+		return
 	}
 
-	logf(1, "[Conn %d] Found %d pending messages\n", cp.connID, len(pendingMessages))
-
-	// If no updates, return differenceEmpty
-	if len(pendingMessages) == 0 {
-		result := &mtproto.TLUpdatesDifferenceEmpty{
+	// The client is too far behind to replay the journal, it has to refetch dialogs
+	if serverPts-clientPts > differenceTooLongGap {
+		logf(1, "[Conn %d] Difference too long: client pts=%d, server pts=%d\n", cp.connID, clientPts, serverPts)
+		result := &mtproto.TLUpdatesDifferenceTooLong{
 			Data2: &mtproto.Updates_Difference{
-				PredicateName: "updates_differenceEmpty",
-				Constructor:   1567990072,
-				Date:          serverDate,
-				Seq:           serverSeq,
+				PredicateName: "updates_differenceTooLong",
+				Constructor:   1258196845,
+				Pts:           serverPts,
 			},
 		}
 		cp.encodeAndSend(result, msgId, salt, sessionId, 512)
 		return
 	}
 
-	// Build updates for new messages
-	var updates []*mtproto.Update
+	entries, err := GetUserUpdatesSince(cp.userID, clientPts, differenceSliceLimit)
+	if err != nil {
+		logf(1, "[Conn %d] Failed to read update log: %v\n", cp.connID, err)
+		entries = []UpdateLogDoc{}
+	}
+
+	logf(1, "[Conn %d] Found %d journal entries after pts %d\n", cp.connID, len(entries), clientPts)
+
+	// AppendUserUpdate allocates pts before it stores the entry, so a
+	// concurrent append can leave a hole. Stop in front of it rather than
+	// move the client past an update it never saw.
+	fetched := len(entries)
+	now := time.Now()
+	entries = contiguousUpdates(entries, clientPts, now)
+	reached := clientPts
+	if len(entries) > 0 {
+		reached = entries[len(entries)-1].Pts
+	}
+	// Nothing after the last entry can be a fresh hole if no pts was
+	// allocated within updateGapGrace
+	partial := reached < serverPts && (len(entries) < fetched || fetched == differenceSliceLimit ||
+		now.Sub(time.Unix(int64(serverDate), 0)) < updateGapGrace)
+	if partial && len(entries) == 0 {
+		logf(1, "[Conn %d] Update after pts %d is still being written\n", cp.connID, clientPts)
+		cp.sendDifferenceEmpty(serverDate, serverSeq, msgId, salt, sessionId)
+		return
+	}
+
+	// New messages go to new_messages, everything else to other_updates
 	var messages []*mtproto.Message
+	var updates []*mtproto.Update
 	var users []*mtproto.User
 	userMap := make(map[int64]bool)
 
-	for _, msg := range pendingMessages {
-		// For the RECIPIENT (cp.userID), this is an incoming message
-		// Message.PeerId should point to the OTHER person in the dialog (the sender, msg.FromID)
-		// Message.Out should be false (incoming)
-		// Message.FromId should be the actual sender
-		updates = append(updates, &mtproto.Update{
-			PredicateName: "updateNewMessage",
-			Constructor:   522914557,
-			Message_MESSAGE: &mtproto.Message{
-				PredicateName: "message",
-				Constructor:   940666592,
-				Id:            msg.ID,
-				PeerId: &mtproto.Peer{
-					PredicateName: "peerUser",
-					Constructor:   1498486562,
-					UserId:        msg.FromID, // Dialog peer = the sender (the OTHER person)
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Type == UpdateTypeNewMessage {
+			messages = append(messages, entry.ToMessage())
+		} else if update := entry.ToUpdate(); update != nil {
+			updates = append(updates, update)
+		}
+
+		// Add the dialog peer to user map
+		if entry.PeerUserID == 0 || userMap[entry.PeerUserID] {
+			continue
+		}
+		userMap[entry.PeerUserID] = true
+		peerUser, err := FindUserByID(entry.PeerUserID)
+		if err == nil && peerUser != nil {
+			users = append(users, &mtproto.User{
+				PredicateName: "user",
+				Constructor:   -1885878744,
+				Id:            peerUser.ID,
+				Contact:       true,
+				MutualContact: true,
+				AccessHash: &wrapperspb.Int64Value{
+					Value: peerUser.AccessHash,
 				},
-				Out: false, // Incoming message for the recipient
-				FromId: &mtproto.Peer{
-					PredicateName: "peerUser",
-					Constructor:   1498486562,
-					UserId:        msg.FromID, // Actual sender
+				FirstName: &wrapperspb.StringValue{
+					Value: peerUser.FirstName,
 				},
-				Date:    msg.Date,
-				Message: msg.Message,
-			},
-			Pts_INT32: msg.Pts,
-			PtsCount:  1,
-		})
-
-		// Also add to messages array
-		messages = append(messages, &mtproto.Message{
-			PredicateName: "message",
-			Constructor:   940666592,
-			Id:            msg.ID,
-			PeerId: &mtproto.Peer{
-				PredicateName: "peerUser",
-				Constructor:   1498486562,
-				UserId:        msg.FromID, // Dialog peer = the sender (the OTHER person)
-			},
-			Out: false,
-			FromId: &mtproto.Peer{
-				PredicateName: "peerUser",
-				Constructor:   1498486562,
-				UserId:        msg.FromID,
-			},
-			Date:    msg.Date,
-			Message: msg.Message,
-		})
-
-		// Add sender to user map
-		if !userMap[msg.FromID] {
-			userMap[msg.FromID] = true
-			sender, err := FindUserByID(msg.FromID)
-			if err == nil && sender != nil {
-				users = append(users, &mtproto.User{
-					PredicateName: "user",
-					Constructor:   -1885878744,
-					Id:            sender.ID,
-					Contact:       true,
-					MutualContact: true,
-					AccessHash: &wrapperspb.Int64Value{
-						Value: sender.AccessHash,
-					},
-					FirstName: &wrapperspb.StringValue{
-						Value: sender.FirstName,
-					},
-					LastName: &wrapperspb.StringValue{
-						Value: sender.LastName,
-					},
-					Phone: &wrapperspb.StringValue{
-						Value: sender.Phone,
-					},
-					Status: &mtproto.UserStatus{
-						PredicateName: "userStatusOffline",
-						Constructor:   9203775,
-						WasOnline:     int32(sender.LastSeenAt.Unix()),
-					},
-				})
-			}
+				LastName: &wrapperspb.StringValue{
+					Value: peerUser.LastName,
+				},
+				Phone: &wrapperspb.StringValue{
+					Value: peerUser.Phone,
+				},
+				Status: &mtproto.UserStatus{
+					PredicateName: "userStatusOffline",
+					Constructor:   9203775,
+					WasOnline:     int32(peerUser.LastSeenAt.Unix()),
+				},
+			})
 		}
 	}
 
@@ -179,36 +169,65 @@ func (cp *ConnProp) HandleUpdatesGetDifference(obj *mtproto.TLUpdatesGetDifferen
 		}
 	}
 
-	// Update user's pts to match the highest pts we're delivering
-	if len(pendingMessages) > 0 {
-		highestPts := pendingMessages[len(pendingMessages)-1].Pts
-		err = UpdateUserPts(cp.userID, highestPts)
-		if err != nil {
-			logf(1, "[Conn %d] Failed to update user pts: %v\n", cp.connID, err)
+	state := &mtproto.Updates_State{
+		PredicateName: "updates_state",
+		Constructor:   -1519637954,
+		Pts:           serverPts,
+		Qts:           serverQts,
+		Date:          serverDate,
+		Seq:           serverSeq,
+		UnreadCount:   0,
+	}
+
+	// More entries remain: return a slice up to the last entry we included
+	if partial {
+		last := entries[len(entries)-1]
+		state.Pts = last.Pts
+		state.Date = last.Date
+		logf(1, "[Conn %d] Returning difference slice up to pts %d of %d\n", cp.connID, last.Pts, serverPts)
+
+		result := &mtproto.TLUpdatesDifferenceSlice{
+			Data2: &mtproto.Updates_Difference{
+				PredicateName:        "updates_differenceSlice",
+				Constructor:          -1459938943,
+				NewMessages:          messages,
+				NewEncryptedMessages: []*mtproto.EncryptedMessage{},
+				OtherUpdates:         updates,
+				Chats:                []*mtproto.Chat{},
+				Users:                users,
+				IntermediateState:    state,
+			},
 		}
+		cp.encodeAndSend(result, msgId, salt, sessionId, 8192)
+		return
 	}
 
-	// Return updates.difference with the pending messages
+	// Return updates.difference with everything after the client's pts
 	result := &mtproto.TLUpdatesDifference{
 		Data2: &mtproto.Updates_Difference{
-			PredicateName:  "updates_difference",
-			Constructor:    16030880,
-			NewMessages:    messages,
+			PredicateName:        "updates_difference",
+			Constructor:          16030880,
+			NewMessages:          messages,
 			NewEncryptedMessages: []*mtproto.EncryptedMessage{},
-			OtherUpdates:   updates,
-			Chats:          []*mtproto.Chat{},
-			Users:          users,
-			State: &mtproto.Updates_State{
-				PredicateName: "updates_state",
-				Constructor:   -1519637954,
-				Pts:           serverPts,
-				Qts:           serverQts,
-				Date:          serverDate,
-				Seq:           serverSeq,
-				UnreadCount:   0,
-			},
+			OtherUpdates:         updates,
+			Chats:                []*mtproto.Chat{},
+			Users:                users,
+			State:                state,
 		},
 	}
 
 	cp.encodeAndSend(result, msgId, salt, sessionId, 8192)
 }
+
+// sendDifferenceEmpty tells the client it has every update there is for now
+func (cp *ConnProp) sendDifferenceEmpty(date, seq int32, msgId, salt, sessionId int64) {
+	result := &mtproto.TLUpdatesDifferenceEmpty{
+		Data2: &mtproto.Updates_Difference{
+			PredicateName: "updates_differenceEmpty",
+			Constructor:   1567990072,
+			Date:          date,
+			Seq:           seq,
+		},
+	}
+	cp.encodeAndSend(result, msgId, salt, sessionId, 512)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/binary"
 	"time"
 
 	"github.com/teamgram/proto/mtproto"
@@ -12,6 +11,11 @@ import (
 func (cp *ConnProp) HandleContactsGetContacts(obj *mtproto.TLContactsGetContacts, msgId, salt, sessionId int64) {
 	logf(1, "[Conn %d] contacts.getContacts for user %d\n", cp.connID, cp.userID)
 
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+
 	result := &mtproto.TLContactsContacts{
 		Data2: &mtproto.Contacts_Contacts{
 			PredicateName: "contacts_contacts",
@@ -29,6 +33,11 @@ func (cp *ConnProp) HandleContactsGetContacts(obj *mtproto.TLContactsGetContacts
 func (cp *ConnProp) HandleMessagesGetPeerDialogs(obj *mtproto.TLMessagesGetPeerDialogs, msgId, salt, sessionId int64) {
 	logf(1, "[Conn %d] messages.getPeerDialogs for user %d\n", cp.connID, cp.userID)
 
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+
 	peers := obj.GetPeers()
 	var dialogs []*mtproto.Dialog
 	var messages []*mtproto.Message
@@ -193,9 +202,15 @@ func (cp *ConnProp) HandleMessagesGetPeerDialogs(obj *mtproto.TLMessagesGetPeerD
 func (cp *ConnProp) HandleUsersGetFullUser(obj *mtproto.TLUsersGetFullUser, msgId, salt, sessionId int64) {
 	logf(1, "[Conn %d] users.getFullUser\n", cp.connID)
 
+	if cp.userID == 0 {
+		cp.sendRpcError(mtproto.ErrAuthKeyUnregistered, msgId, salt, sessionId)
+		return
+	}
+
 	inputUser := obj.GetId()
 	if inputUser == nil {
 		logf(1, "[Conn %d] No user ID in request\n", cp.connID)
+		cp.sendRpcError(mtproto.ErrUserIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -218,6 +233,7 @@ func (cp *ConnProp) HandleUsersGetFullUser(obj *mtproto.TLUsersGetFullUser, msgI
 		}
 	default:
 		logf(1, "[Conn %d] Unknown inputUser predicate: %s\n", cp.connID, inputUser.PredicateName)
+		cp.sendRpcError(mtproto.ErrUserIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -225,8 +241,14 @@ func (cp *ConnProp) HandleUsersGetFullUser(obj *mtproto.TLUsersGetFullUser, msgI
 
 	// Get user from database
 	user, err := FindUserByID(requestedUserId)
-	if err != nil || user == nil {
+	if err != nil {
 		logf(1, "[Conn %d] Failed to find user %d: %v\n", cp.connID, requestedUserId, err)
+		cp.sendRpcError(mtproto.ErrInternalServerError, msgId, salt, sessionId)
+		return
+	}
+	if user == nil {
+		logf(1, "[Conn %d] User %d not found\n", cp.connID, requestedUserId)
+		cp.sendRpcError(mtproto.ErrUserIdInvalid, msgId, salt, sessionId)
 		return
 	}
 
@@ -275,25 +297,12 @@ func (cp *ConnProp) HandleUsersGetFullUser(obj *mtproto.TLUsersGetFullUser, msgI
 		Chats:         []*mtproto.Chat{},
 		Users:         []*mtproto.User{userObj}}
 
-	// Encode the result with layer 158
-	resbuf := mtproto.NewEncodeBuf(1024)
-	result.Encode(resbuf, 158)
-
-	resbuff := resbuf.GetBuf()
-
-	// Patch offset 4 to use old UserFull constructor
-	// The encoding writes constructor -1813324973 (0x93eadb53) for layer 158,
-	// but the Android client expects -120378643 (0xf8d32aed), an older UserFull variant.
-	// This cannot be controlled via the Constructor field - the library overrides it based on layer.
-	if len(resbuff) >= 8 {
-		binary.LittleEndian.PutUint32(resbuff[4:8], 4174588653) // -120378643 as uint32
-	}
-
-	// Send the patched response
-	buf := mtproto.NewEncodeBuf(12 + len(resbuff))
+	// The userFull constructor depends on the layer (0xf8d32aed up to 157,
+	// 0x93eadb53 from 158), so the client's layer picks the right variant
+	buf := mtproto.NewEncodeBuf(1024)
 	buf.Int(-212046591) // rpc_result
 	buf.Long(msgId)
-	buf.Bytes(resbuff)
+	result.Encode(buf, cp.encodeLayer())
 	cp.send(buf.GetBuf(), salt, sessionId)
 }
 